@@ -1,368 +1,274 @@
 package main
 
 import (
+	"embed"
 	"encoding/json"
 	"fmt"
 	"log"
-	"io"
 	"net/http"
-)
+	"strconv"
+	"time"
 
-// SrvConfig defines the far-end server, and its command and payload ports
-type SrvConfig struct {
-	Host    string
-	RPCPort string
-	Count   uint64
-	Repeat  bool
-}
+	"github.com/9nut/tcpmeter/stats"
+)
 
 // Command controls the type of function that TCPClient should perform
 type Command struct {
-	Name string
-	Cfg  SrvConfig
+	Name  string
+	Cfg   stats.Config
+	ID    string        // of a test submitted through Tests; copied to its Stats
+	Abort chan struct{} // closed to end the test early; may be nil
 }
 
-type BitRate uint64
-
-// Returns bitrate in Mega-bits per second
-func (b BitRate) Mbps() float32 {
-	return float32(b) / float32(1000000)
+// Stats is type of measurement that TCPClient reports on its stats channel.
+type Stats struct {
+	ID     string // of the test, if it has one
+	Stat   string
+	Type   string
+	Rate   stats.BitRate
+	Steady bool
+	TPS    float64        // transactions per second, for CRR and RR tests
+	Sum    *stats.Summary // set only when Stat is "Done"
+	Host   string         // server of a failed test
+	Reason string         // classification of Err
+	Err    string         // set only when Stat is "Error"
+	Regr   *Regression    // set when a summary falls short of its baseline
 }
 
-// Returns bitrate in Mega-bytes per second
-func (b BitRate) MBps() float32 {
-	return float32(b) / float32(8*1000000)
+type JSONStats struct {
+	ID     string `json:",omitempty"`
+	Stat   string
+	Type   string
+	Rate   float64
+	Steady bool
+	TPS    float64
+	Sum    *JSONSummary `json:",omitempty"`
+	Reason string       `json:",omitempty"`
+	Err    string       `json:",omitempty"`
+	Regr   *Regression  `json:",omitempty"`
 }
 
-// Returns bitrate in Kilo-bits per second
-func (b BitRate) Kbps() float32 {
-	return float32(b) / float32(1000)
-}
+// JSONSummary is Summary with rates in Mbps, time in seconds and CPU use in
+// percent.
+type JSONSummary struct {
+	Bytes    uint64
+	SrvBytes uint64
+	Elapsed  float64
+	Avg      float64
+	Peak     float64
+	Min      float64
+	StdDev   float64
 
-// Returns bitrate in Kilo-bytes per second
-func (b BitRate) KBps() float32 {
-	return float32(b) / float32(8*1000)
-}
+	SrvElapsed float64
+	Send       float64
+	Recv       float64
+	Skewed     bool
+	SrvCPU     []float64 `json:",omitempty"`
 
-func (b BitRate) String() string {
-	return fmt.Sprintf("%d", b)
+	Txns uint64
+	TPS  float64
+	Lat  *JSONLatency `json:",omitempty"`
 }
 
-// Stats is type of measurement that TCPClient reports on its stats channel.
-type Stats struct {
-	Stat string
-	Type string
-	Rate BitRate
+// JSONLatency is Latency in milliseconds.
+type JSONLatency struct {
+	N    int
+	Min  float64
+	Mean float64
+	Max  float64
+	P50  float64
+	P90  float64
+	P99  float64
+	P999 float64
 }
 
-type JSONStats struct {
-	Stat string
-	Type string
-	Rate float32
+func ms(d time.Duration) float64 {
+	return d.Seconds() * 1000
 }
 
 // CCmdHandler is the receiver type for handling TCPClient control request
 type CCmdHandler struct {
-	CmdCh chan Command
+	T *Tests
 }
 
 // CStatHandler is the reciever type for handling TCPClient stats requests
 type CStatHandler struct {
-	StatCh chan Stats
+	Hub *Hub
+	T   *Tests
 }
 
 // This handler parses the form from the user and initiates a TCPClient
-// measurement.
+// measurement. The form is checked as a Job is.
 func (c *CCmdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var (
-		raddr  string
-		rport  int
-		pktt   string
-		tstt   string
-		txsize int
-		txmult string
-		txcont string
-	)
-	params := map[string]interface{}{
-		"raddr":  &raddr,
-		"rport":  &rport,
-		"pktt":   &pktt,
-		"tstt":   &tstt,
-		"txsize": &txsize,
-		"txmult": &txmult,
-		"txcont": &txcont,
+	j, bad := formjob(r)
+	trace.Printf("|CMD|%s|%s|\n", j.Test, j.Host)
+	log.Println("CMD: ", r.Form)
+
+	cmd, err := j.Command()
+	if err != nil {
+		bad = append(bad, err.(JobError)...)
 	}
-	Mult := map[string]uint64{
-		"KB": 1024,
-		"MB": 1024 * 1024,
-		"GB": 1024 * 1024 * 1024,
+	if len(bad) > 0 {
+		http.Error(w, bad.Error(), http.StatusBadRequest)
+		return
 	}
-
-	getformparams(r, params)
-	trace.Printf("|CMD|%s|%s|\n", tstt, raddr)
-	log.Println("CMD: ", raddr, rport, pktt, tstt, txsize, txmult, txcont != "")
-
-	cmd := Command{
-		Name: tstt,
-		Cfg: SrvConfig{
-			Host:    raddr,
-			RPCPort: fmt.Sprint(rport),
-			Count:   uint64(txsize) * Mult[txmult],
-			Repeat:  txcont != "",
-		},
+	cmd.Cfg.Repeat = r.FormValue("txcont") != ""
+	t, err := c.T.Submit(cmd, sessionid(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	c.CmdCh <- cmd
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(""))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(t.ID))
 }
 
-// parse and store form parameters in the map that's passed in
-func getformparams(r *http.Request, params map[string]interface{}) {
-	for i, x := range params {
-		if v := r.FormValue(i); v != "" {
-			fmt.Sscan(v, x)
+// formjob reads the Job that the form of the WebUI asks for, and what it
+// can't make out of the form.
+func formjob(r *http.Request) (Job, JobError) {
+	var bad JobError
+	j := Job{Test: r.FormValue("tstt"), Host: r.FormValue("raddr"), Port: r.FormValue("rport"),
+		Stop: r.FormValue("txstop") != ""}
+	if s := r.FormValue("txsize"); s != "" {
+		j.Size = s + r.FormValue("txmult")
+	}
+	secs := func(name string) string {
+		s := r.FormValue(name)
+		if s == "" {
+			return ""
+		}
+		if _, err := strconv.ParseUint(s, 10, 32); err != nil {
+			bad = append(bad, fmt.Sprintf("%s: bad number of seconds %q", name, s))
+			return ""
+		}
+		return s + "s"
+	}
+	j.Omit, j.Dur = secs("txomit"), secs("txdur")
+	if s := r.FormValue("steady"); s != "" {
+		var err error
+		if j.Steady, err = strconv.ParseFloat(s, 64); err != nil {
+			bad = append(bad, fmt.Sprintf("steady: bad percentage %q", s))
 		}
 	}
+	for _, f := range []struct {
+		name string
+		n    **uint64
+	}{{"reqsz", &j.Req}, {"rspsz", &j.Resp}} {
+		s := r.FormValue(f.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			bad = append(bad, fmt.Sprintf("%s: bad size %q", f.name, s))
+			continue
+		}
+		*f.n = &n
+	}
+	return j, bad
+}
+
+// Mult gives the multipliers of data size units
+var Mult = map[string]uint64{
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+}
+
+func jsonsummary(sm *stats.Summary) *JSONSummary {
+	js := &JSONSummary{
+		Bytes:      sm.Bytes,
+		SrvBytes:   sm.SrvBytes,
+		Elapsed:    sm.Elapsed.Seconds(),
+		Avg:        sm.Avg.Mbps(),
+		Peak:       sm.Peak.Mbps(),
+		Min:        sm.Min.Mbps(),
+		StdDev:     sm.StdDev.Mbps(),
+		SrvElapsed: sm.SrvElapsed.Seconds(),
+		Send:       sm.Send.Mbps(),
+		Recv:       sm.Recv.Mbps(),
+		Skewed:     sm.Skewed,
+		Txns:       sm.Txns,
+		TPS:        sm.TPS,
+	}
+	for _, u := range sm.SrvCPU {
+		js.SrvCPU = append(js.SrvCPU, u*100)
+	}
+	if l := sm.Lat; l != nil {
+		js.Lat = &JSONLatency{l.N, ms(l.Min), ms(l.Mean), ms(l.Max),
+			ms(l.P50), ms(l.P90), ms(l.P99), ms(l.P999)}
+	}
+	return js
 }
 
 // This handler deals with GET requests for TCPClient measurement results.
-// It returns the measurements since last snapshot in json format.
+// It returns the next measurement in json format; the web UI itself
+// follows /events instead.
 func (s *CStatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var jst JSONStats
 	w.Header().Set("Content-Type", "text/plain")
-	st, ok := <-s.StatCh
-	if !ok {
-		jst = JSONStats{Stat: "Error"}
-	} else {
-		jst = JSONStats{st.Stat, st.Type, st.Rate.Mbps()}
+	ch := s.Hub.Subscribe(viewer(r, s.T))
+	defer s.Hub.Unsubscribe(ch)
+	select {
+	case st, ok := <-ch:
+		if !ok {
+			jst = JSONStats{Stat: "Error"}
+		} else {
+			jst = jsonstats(&st)
+		}
+	case <-r.Context().Done():
+		return
 	}
 	je := json.NewEncoder(w)
 	je.Encode(jst)
 }
 
+// the web UI: its pages and the scripts and styles they share, all
+// served from the binary so that it works without outside access
+//
+//go:embed ui
+var uifiles embed.FS
+
+// page serves one of the embedded pages.
+func page(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := uifiles.ReadFile(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(b)
+	}
+}
+
 // WebUI is an http server that provides an html UI to the user, annoucing itself at address
 // that is passed in. It handles requests for starting and stopping of the load testing
 // client and reporting of data.
-func WebUI(addr string, cch chan Command, sch chan Stats) {
-	cl := &CCmdHandler{cch}
-	st := &CStatHandler{sch}
+func WebUI(addr string, ts *Tests, hub *Hub) {
+	cl := &CCmdHandler{ts}
+	st := &CStatHandler{hub, ts}
 	http.Handle("/cmd", cl)
 	http.Handle("/stats", st)
+	http.Handle("/events", &CEventHandler{hub, ts})
+	api := &APIHandler{ts}
+	http.Handle(apiTests, api)
+	http.Handle(apiTests+"/", api)
+	http.Handle("/metrics", metrics)
+	hh := &HistHandler{history}
+	http.Handle("/history", hh)
+	http.Handle("/history/", hh)
+	http.Handle("/baseline", &BaseHandler{baselines})
+	http.Handle("/report", &ReportHandler{history})
+	http.Handle("/ui/", http.FileServer(http.FS(uifiles)))
+	http.Handle("/runs", page("ui/runs.html"))
+	http.Handle("/trends", page("ui/trends.html"))
+	meter := page("ui/index.html")
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		io.WriteString(w, htmlfile)
-
+		startsession(w, r)
+		meter(w, r)
 	})
 	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: " + err.Error())
 	}
 }
-
-// unfortunately there isn't an easy way to include
-// a file; so make the changes to index.html and then
-// replace the contents of the htmlfile const with it.
-const htmlfile = `
-<!DOCTYPE html>
-<html>
-  <head>
-    <script type='text/javascript' src='https://www.google.com/jsapi'></script>
-    <script src="http://yui.yahooapis.com/3.8.0/build/yui/yui-min.js"></script>
-    <script type='text/javascript'>
-      google.load('visualization', '1', {packages:['corechart', 'gauge']});
-	</script>
-	<script type='text/javascript'>
-    YUI().use("node", "io", "io-form", "event", "dump", "json-parse", "button", function(Y) {
-        var that = this;
-        var running = false;
-        var gauge_options = {
-            width: 200, height: 200,
-            redFrom: 0, redTo: 10,
-            yellowFrom: 10, yellowTo: 50,
-            greenFrom: 50, greenTo: 100,
-            minorTicks: 6,
-        };
-        var chart_options = {
-            width: 600, height: 200,
-            title : 'Megabits / Second',
-            animation : { duration : 500 },
-        };
-
-        var upgauge = new google.visualization.Gauge(Y.one('#upgauge').getDOMNode());
-        var dngauge = new google.visualization.Gauge(Y.one('#dngauge').getDOMNode());
-        var upchart = new google.visualization.LineChart(Y.one('#upchart').getDOMNode());
-        var dnchart = new google.visualization.LineChart(Y.one('#dnchart').getDOMNode());
-        var dtable = new google.visualization.DataTable();
-        var lUp = 0, lDown = 0;
-        dtable.addColumn('timeofday', 'Time');
-        dtable.addColumn('number', 'Bitrate');
-        upchart.draw(dtable, chart_options);
-        dnchart.draw(dtable, chart_options);
-        upgauge.draw(google.visualization.arrayToDataTable([['Label', 'Value'], ['Upload', 0]]), gauge_options);
-        dngauge.draw(google.visualization.arrayToDataTable([['Label', 'Value'], ['Download', 0]]), gauge_options);
-
-        var onSuccess = function (id, o, args) {
-            dtable = new google.visualization.DataTable();
-            dtable.addColumn('timeofday', 'Time');
-            dtable.addColumn('number', 'Bitrate');
-            Y.one('#status_div').setHTML("<i>Starting...</i>");
-            Y.all('#tstreqform input').setAttribute('disabled', 'disabled');
-            Y.later(250, that, updateVisuals, false);  // give it time so that GET "/stats" doesn't fail right away
-        };
-        var onFailure = function (id, o, args) {
-            Y.one('#start').removeAttribute('disabled');
-            Y.all('#tstreqform input').removeAttribute('disabled');
-            running = false;
-            Y.one('#params_div').setStyle('opacity', '');
-        }
-
-        var enableForm = function () {
-            Y.one('#start').removeAttribute('disabled');
-            Y.all('#tstreqform input').removeAttribute('disabled');
-            running = false;
-            Y.one('#params_div').setStyle('opacity', '');
-        };
-        Y.one('#start').on('click', function(e) {
-            if (running) return;
-            Y.one('#start').setAttribute('disabled', 'disabled');
-            running = true;
-            Y.one('#params_div').setStyle('opacity', '0.4');
-            e.halt(true);
-            var cfg = {
-                method : "POST",
-                form : { id : Y.one('#tstreqform'), useDisabled : false },
-                on : { success : onSuccess , failure : onFailure },
-                context : Y,
-                arguments : { success : '/cmd' },
-            };
-            Y.io("/cmd", cfg);
-        });
-
-        enableForm();
-        /*
-        Y.one('#stop').on('click', function(e) {
-            var cfg = { method : "POST", data : "tstt=STOP" }
-            Y.io("/cmd", cfg);
-        });
-        */
-
-        var updateVisuals = function () {
-            Y.io("/stats", {
-                on : {
-                    success : function (tx, r) {
-                        var pr;
-                        try {
-                            pr = Y.JSON.parse(r.responseText);
-                        } catch (e) {
-                            alert("JSON Parse failed: ", r.responseText);
-                            Y.one('#status_div').setHTML("<i>Error: "+e+"</i>");
-                            enableForm();
-                            return;
-                        }
-                        var msg = pr.Stat + " " + ((pr.Type=="UP")?"Upload":((pr.Type=="DOWN")?"Download":''));
-                        Y.one('#status_div').setHTML("<i>"+msg+"</i>");
-                        if (pr.Stat != "Running") {
-                            enableForm();
-                            return;
-                        }
-                        var foo = new Date();
-                        var xtm = [foo.getHours(), foo.getMinutes(), foo.getSeconds(), foo.getMilliseconds()];
-                        dtable.addRows([[xtm, pr.Rate]]);
-                        if (pr.Type == "UP") {
-                            upchart.draw(dtable, chart_options);
-                            lUp = pr.Rate;
-                            var dt = google.visualization.arrayToDataTable([
-                                ['Label', 'Value'],
-                                ['Upload', lUp ]
-                                ]);
-                            upgauge.draw(dt, gauge_options);
-                        } else {
-                            dnchart.draw(dtable, chart_options);
-                            lDown = pr.Rate;
-                            var dt = google.visualization.arrayToDataTable([
-                                ['Label', 'Value'],
-                                ['Download', lDown ]
-                                ]);
-                            dngauge.draw(dt, gauge_options);
-                        }
-                        Y.later(500, that, updateVisuals, false);
-                    },
-                    failure : function (tx, r) {
-                        alert("No data");
-                        enableForm();
-                    },
-                },
-            });
-        };
-    });
-    </script>
-	<link rel="stylesheet" type="text/css" href="http://yui.yahooapis.com/3.8.0/build/cssfonts/cssfonts-min.css">
-    <link rel="stylesheet" type="text/css" href="http://yui.yahooapis.com/3.8.0/build/cssgrids/grids-min.css">
-  </head>
-  <body>
-   <div> <!-- class="yui3-cssfonts"> -->
-    <h1>tcpmeter - TCP Speedometer</h1>
-    <div class="yui3-skin-sam">
-      <div class="yui3-g">
-        <div id="params_div" class="yui3-u-1-4">
-          <form id="tstreqform" method="post" action="/cmd">
-			<fieldset>
-			  <legend>Server Information</legend>
-              <p>
-              <label>Host:<input type=text name=raddr required></label><br />
-              <label>RPC:<input type=number name=rport default="8001" placeholder="8001" required></label>
-              </p>
-			</fieldset>
-            <p>
-            <fieldset>
-              <legend>Packet Type</legend>
-              <p>
-              <input type=radio name=pktt value="udp" disabled="disabled">UDP</input>
-              <input type=radio name=pktt value="tcp" checked="checked">TCP</input>
-              </p>
-            </fieldset>
-            </p>
-            <p>
-            <fieldset>
-              <legend>Type of Measurement</legend>
-              <p>
-              <input type=radio name=tstt value="UP" checked="checked">Upload</input>
-              <input type=radio name=tstt value="DOWN">Download</input>
-              <input type=radio name=tstt value="RTT">Round Trip</input><br />
-              <input type=checkbox name=txcont checked="">Continuous</input>
-              </p>
-            </fieldset>
-            </p>
-            <p>
-            <fieldset>
-              <legend>Size of Dataset</legend>
-              <p>
-              <label>Amount of data:<input type=number name=txsize></label><br />
-              <input type=radio name=txmult value="KB">KB</input>
-              <input type=radio name=txmult value="MB" checked="checked">MB</input>
-              <input type=radio name=txmult value="GB">GB</input>
-              </p>
-            </fieldset>
-            </p>
-          </form>
-          <p>
-          <input id="start" type="button" value="Start" />
-          <!-- <input id="stop" type="button" value="Abort" /> -->
-          </p>
-        </div>
-		<div class="yui3-u-3-4">
-            <div class="yui3-g">
-                <div class="yui3-u-1-4" id='upgauge'></div>
-                <div class="yui3-u-3-4" id='upchart'></div>
-            </div>
-            <div class="yui3-g">
-                <div class="yui3-u-1-4" id='dngauge'></div>
-                <div class="yui3-u-3-4" id='dnchart'></div>
-            </div>
-            <div id='status_div' style="text-align:center"><p><i>Stopped</i></p></div>
-		</div>
-      </div>
-    </div>
-   </div>
-  </body>
-</html>`
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rule is an alert condition on the results of a server and test. Empty
+// Host or Test match any. A rule fires once its condition has held for For
+// consecutive runs, and is resolved by the next run that passes.
+type Rule struct {
+	Name string
+	Host string
+	Test string
+	For  int // consecutive runs; 1 if zero
+
+	Below       float64 // rate under this many Mbps, or transactions/s for CRR and RR
+	LatAbove    float64 // p99 latency over this many milliseconds, for CRR and RR
+	Unreachable bool    // the test failed to reach the server
+	Regression  bool    // the result fell short of its baseline
+}
+
+// Alert is the JSON payload posted to the hooks.
+type Alert struct {
+	Rule   string
+	State  string // "firing" or "resolved"
+	Host   string
+	Test   string
+	Count  int     // consecutive runs the condition held
+	Value  float64 `json:",omitempty"` // what was measured, in the units of the rule
+	Limit  float64 `json:",omitempty"`
+	Reason string  `json:",omitempty"` // why the server was unreachable
+	Time   time.Time
+}
+
+// Alerter evaluates rules after each test and delivers alerts to webhooks.
+// It is configured from a JSON file such as
+//
+//	{
+//		"Hooks": ["http://alerts.example.com/tcpmeter"],
+//		"Rules": [
+//			{"Name": "slow lab1 download", "Host": "lab1", "Test": "DOWN", "Below": 200, "For": 3},
+//			{"Name": "lab1 down", "Host": "lab1", "Unreachable": true}
+//		]
+//	}
+type Alerter struct {
+	Hooks   []string
+	Retries int // delivery attempts per hook; 5 if zero
+	Rules   []Rule
+
+	mu     sync.Mutex
+	counts map[string]int // rule and link -> consecutive violations
+	wg     sync.WaitGroup // deliveries in progress
+}
+
+// alerts evaluates every completed or failed test; see LogClient.
+var alerts *Alerter
+
+// longest wait between delivery attempts
+const maxBackoff = time.Minute
+
+// LoadAlerts reads the alert configuration in the file at path.
+func LoadAlerts(path string) (*Alerter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := new(Alerter)
+	if err = json.NewDecoder(f).Decode(a); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, r := range a.Rules {
+		if r.Below <= 0 && r.LatAbove <= 0 && !r.Unreachable && !r.Regression {
+			return nil, fmt.Errorf("%s: rule %d has no condition", path, i+1)
+		}
+		if r.Name == "" {
+			a.Rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	if len(a.Hooks) == 0 {
+		return nil, errors.New(path + ": no Hooks")
+	}
+	return a, nil
+}
+
+// check tells whether st violates r, and the value and limit compared.
+func (r *Rule) check(st *Stats) (bad bool, v, lim float64) {
+	if st.Stat == "Error" {
+		return r.Unreachable && unreachable(st.Reason), 0, 0
+	}
+	sm := st.Sum
+	switch {
+	case r.Regression && st.Regr != nil:
+		return true, st.Regr.Drop * 100, st.Regr.Tol * 100
+	case r.Below > 0 && sm.Lat == nil && sm.Avg.Mbps() < r.Below:
+		return true, sm.Avg.Mbps(), r.Below
+	case r.Below > 0 && sm.Lat != nil && sm.TPS < r.Below:
+		return true, sm.TPS, r.Below
+	case r.LatAbove > 0 && sm.Lat != nil && ms(sm.Lat.P99) > r.LatAbove:
+		return true, ms(sm.Lat.P99), r.LatAbove
+	}
+	return false, 0, 0
+}
+
+// unreachable tells whether a failure reason means the server wasn't reached.
+func unreachable(reason string) bool {
+	switch reason {
+	case "dial", "timeout", "network":
+		return true
+	}
+	return false
+}
+
+// Check evaluates the rules against a Done or Error Stats from a test of
+// host, posting any alerts that fire or resolve.
+func (a *Alerter) Check(host string, st *Stats) {
+	if st.Stat != "Done" && st.Stat != "Error" || st.Stat == "Done" && st.Sum == nil || st.Reason == "aborted" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.counts == nil {
+		a.counts = make(map[string]int)
+	}
+	for i := range a.Rules {
+		r := &a.Rules[i]
+		if r.Host != "" && r.Host != host || r.Test != "" && r.Test != st.Type {
+			continue
+		}
+		if st.Stat == "Error" && !r.Unreachable {
+			continue // says nothing about rates
+		}
+		key := r.Name + "|" + host + "|" + st.Type
+		need := r.For
+		if need < 1 {
+			need = 1
+		}
+		bad, v, lim := r.check(st)
+		n := a.counts[key]
+		al := Alert{Rule: r.Name, Host: host, Test: st.Type, Value: v, Limit: lim, Reason: st.Reason, Time: time.Now()}
+		switch {
+		case bad:
+			a.counts[key] = n + 1
+			if n+1 == need {
+				al.State, al.Count = "firing", n+1
+				a.deliver(al)
+			}
+		case n >= need:
+			delete(a.counts, key)
+			al.State, al.Count, al.Reason = "resolved", n, ""
+			a.deliver(al)
+		default:
+			delete(a.counts, key)
+		}
+	}
+}
+
+// deliver posts al to every hook in the background.
+func (a *Alerter) deliver(al Alert) {
+	log.Println("Alert ", al.State, ": ", al.Rule, " ", al.Host, " ", al.Test)
+	trace.Printf("|ALERT|%s|%s|%s|%s|\n", al.State, al.Rule, al.Host, al.Test)
+	body, err := json.Marshal(al)
+	if err != nil {
+		log.Println("alert: ", err)
+		return
+	}
+	tries := a.Retries
+	if tries < 1 {
+		tries = 5
+	}
+	for _, url := range a.Hooks {
+		a.wg.Add(1)
+		go func(url string) {
+			defer a.wg.Done()
+			wait := time.Second
+			for i := 1; ; i++ {
+				err := post(url, body)
+				if err == nil {
+					return
+				}
+				log.Println("alert: ", url, " attempt ", i, ": ", err)
+				if i == tries {
+					return
+				}
+				time.Sleep(wait)
+				if wait *= 2; wait > maxBackoff {
+					wait = maxBackoff
+				}
+			}
+		}(url)
+	}
+}
+
+// Wait waits for alerts being delivered, including their retries.
+func (a *Alerter) Wait() {
+	a.wg.Wait()
+}
+
+var hookclient = &http.Client{Timeout: 10 * time.Second}
+
+func post(url string, body []byte) error {
+	resp, err := hookclient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
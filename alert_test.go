@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/9nut/tcpmeter/client"
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// receiver is a webhook that answers the first fail posts with 503 and
+// passes on the alerts it takes.
+func receiver(t *testing.T, fail int32) (string, <-chan Alert, *atomic.Int32) {
+	t.Helper()
+	if trace == nil {
+		trace = log.New(io.Discard, "", 0)
+	}
+	got := make(chan Alert, 10)
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if posts.Add(1) <= fail {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		var al Alert
+		if err := json.NewDecoder(r.Body).Decode(&al); err != nil {
+			t.Error(err)
+		}
+		got <- al
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, got, &posts
+}
+
+// done is a Stats of a finished test of type test at mbps.
+func done(test string, mbps float64) *Stats {
+	return &Stats{Stat: "Done", Type: test, Sum: &stats.Summary{Avg: stats.BitRate(mbps * 1e6)}}
+}
+
+// expect returns the alert delivered next, failing if none is within a
+// few seconds.
+func expect(t *testing.T, got <-chan Alert) Alert {
+	t.Helper()
+	select {
+	case al := <-got:
+		return al
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert delivered")
+	}
+	return Alert{}
+}
+
+func TestAlertFor(t *testing.T) {
+	url, got, _ := receiver(t, 0)
+	a := &Alerter{Hooks: []string{url}, Rules: []Rule{{Name: "slow", Test: "DOWN", Below: 100, For: 3}}}
+	a.Check("lab1", done("DOWN", 50))
+	a.Check("lab1", done("DOWN", 50))
+	a.Check("lab1", done("DOWN", 500)) // starts the count again
+	a.Check("lab1", done("DOWN", 50))
+	a.Check("lab1", done("DOWN", 50))
+	a.Check("lab2", done("DOWN", 50)) // another link
+	a.Check("lab1", done("UP", 50))   // another test
+	a.Wait()
+	select {
+	case al := <-got:
+		t.Fatalf("alert before 3 consecutive slow runs: %+v", al)
+	default:
+	}
+	a.Check("lab1", done("DOWN", 50))
+	al := expect(t, got)
+	if al.Rule != "slow" || al.State != "firing" || al.Host != "lab1" || al.Count != 3 || al.Value != 50 || al.Limit != 100 {
+		t.Errorf("alert %+v, want slow lab1 firing after 3 runs at 50 below 100", al)
+	}
+	a.Check("lab1", done("DOWN", 50)) // still firing, not posted again
+	a.Wait()
+	select {
+	case al := <-got:
+		t.Errorf("alert posted again while firing: %+v", al)
+	default:
+	}
+}
+
+func TestAlertResolved(t *testing.T) {
+	url, got, _ := receiver(t, 0)
+	a := &Alerter{Hooks: []string{url}, Rules: []Rule{{Name: "slow", Below: 100, For: 2}}}
+	a.Check("lab1", done("UP", 50))
+	a.Check("lab1", done("UP", 50))
+	a.Check("lab1", done("UP", 50))
+	if al := expect(t, got); al.State != "firing" {
+		t.Fatalf("alert %+v, want firing", al)
+	}
+	a.Check("lab1", done("UP", 500))
+	if al := expect(t, got); al.State != "resolved" || al.Count != 3 {
+		t.Errorf("alert %+v, want resolved after 3 runs", al)
+	}
+	// once resolved, a pass says nothing
+	a.Check("lab1", done("UP", 500))
+	a.Wait()
+	select {
+	case al := <-got:
+		t.Errorf("alert after resolution: %+v", al)
+	default:
+	}
+}
+
+func TestAlertUnreachable(t *testing.T) {
+	url, got, _ := receiver(t, 0)
+	a := &Alerter{Hooks: []string{url}, Rules: []Rule{
+		{Name: "down", Host: "127.0.0.1", Unreachable: true},
+		{Name: "slow", Below: 100},
+	}}
+	// a port that nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	c := Command{Name: "UP", Cfg: stats.Config{Host: host, RPCPort: port, Count: 1 << 20}}
+	_, err = client.Measure(context.Background(), client.Options{Test: c.Name, Config: c.Cfg})
+	if err == nil {
+		t.Fatal("test of a closed port succeeded")
+	}
+	st := failstats(c, err)
+	a.Check(host, &st)
+	al := expect(t, got)
+	if al.Rule != "down" || al.State != "firing" || al.Reason != "dial" {
+		t.Errorf("alert %+v, want down firing on a dial failure", al)
+	}
+	a.Wait()
+	select {
+	case al := <-got:
+		t.Errorf("a rate rule fired on a failure: %+v", al)
+	default:
+	}
+}
+
+func TestAlertRetry(t *testing.T) {
+	url, got, posts := receiver(t, 1)
+	a := &Alerter{Hooks: []string{url}, Rules: []Rule{{Name: "slow", Below: 100}}}
+	a.Check("lab1", done("UP", 50))
+	al := expect(t, got)
+	if al.State != "firing" || posts.Load() != 2 {
+		t.Errorf("alert %+v after %d posts, want firing after a 503 and a retry", al, posts.Load())
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many tests may wait for the client, and how many finished ones are kept
+const (
+	maxQueued = 64
+	maxTests  = 1000
+)
+
+// Test is a test submitted to Tests, and what has become of it.
+type Test struct {
+	ID      string
+	State   string // queued, running, done, failed or aborted
+	Cmd     Command
+	Session string // the browser session that started it, if any
+	Created time.Time
+	Started time.Time
+	Ended   time.Time
+	Last    Stats // the latest stats of the test
+}
+
+func (t *Test) finished() bool {
+	return t.State == "done" || t.State == "failed" || t.State == "aborted"
+}
+
+// Tests gives each test started from the web UI or the API an id, queues
+// them for TCPClient and follows them through their Stats.
+type Tests struct {
+	mu    sync.Mutex
+	tests map[string]*Test
+	order []string // ids, oldest first
+	queue chan *Test
+}
+
+// tests follows every test with an id; see LogClient.
+var tests *Tests
+
+// ErrQueueFull is returned by Submit when too many tests are waiting.
+var ErrQueueFull = errors.New("too many tests queued")
+
+// NewTests returns a Tests that feeds cch.
+func NewTests(cch chan<- Command) *Tests {
+	ts := &Tests{tests: make(map[string]*Test), queue: make(chan *Test, maxQueued)}
+	go ts.feed(cch)
+	return ts
+}
+
+// feed hands the queued tests to TCPClient in turn, skipping those aborted
+// while they waited.
+func (ts *Tests) feed(cch chan<- Command) {
+	for t := range ts.queue {
+		select {
+		case cch <- t.Cmd:
+		case <-t.Cmd.Abort:
+		}
+	}
+}
+
+func newid() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Submit queues c for the browser session sess, which may be empty, and
+// returns a copy of its Test.
+func (ts *Tests) Submit(c Command, sess string) (Test, error) {
+	c.ID = newid()
+	c.Abort = make(chan struct{})
+	t := &Test{ID: c.ID, State: "queued", Cmd: c, Session: sess, Created: time.Now()}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	select {
+	case ts.queue <- t:
+	default:
+		return *t, ErrQueueFull
+	}
+	ts.tests[t.ID] = t
+	ts.order = append(ts.order, t.ID)
+	ts.prune()
+	trace.Printf("|TEST|%s|%s|%s|\n", t.ID, c.Name, c.Cfg.Host)
+	return *t, nil
+}
+
+// prune forgets the oldest finished tests beyond maxTests; ts.mu must be held.
+func (ts *Tests) prune() {
+	n := len(ts.order) - maxTests
+	if n <= 0 {
+		return
+	}
+	keep := ts.order[:0]
+	for _, id := range ts.order {
+		if t := ts.tests[id]; n > 0 && t.finished() {
+			delete(ts.tests, id)
+			n--
+			continue
+		}
+		keep = append(keep, id)
+	}
+	ts.order = keep
+}
+
+// Get returns a copy of the test with the given id.
+func (ts *Tests) Get(id string) (Test, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tests[id]
+	if !ok {
+		return Test{}, false
+	}
+	return *t, true
+}
+
+// Session returns the browser session that started the test with the given id.
+func (ts *Tests) Session(id string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if t, ok := ts.tests[id]; ok {
+		return t.Session
+	}
+	return ""
+}
+
+// List returns copies of all tests, oldest first.
+func (ts *Tests) List() []Test {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	l := make([]Test, 0, len(ts.order))
+	for _, id := range ts.order {
+		l = append(l, *ts.tests[id])
+	}
+	return l
+}
+
+// Abort ends a queued or running test. It reports false if there is no
+// such test or it has already finished.
+func (ts *Tests) Abort(id string) (Test, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tests[id]
+	if !ok || t.finished() {
+		return Test{}, false
+	}
+	select {
+	case <-t.Cmd.Abort: // already asked
+	default:
+		close(t.Cmd.Abort)
+	}
+	log.Println("Test ", id, " aborted while ", t.State)
+	if t.State == "queued" {
+		t.State, t.Ended = "aborted", time.Now()
+	}
+	return *t, true
+}
+
+// update follows a test through its stats.
+func (ts *Tests) update(st *Stats) {
+	if st.ID == "" {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tests[st.ID]
+	if !ok || t.finished() {
+		return
+	}
+	t.Last = *st
+	switch st.Stat {
+	case "Running":
+		if t.State == "queued" {
+			t.State, t.Started = "running", time.Now()
+		}
+	case "Done":
+		t.State, t.Ended = "done", time.Now()
+	case "Error":
+		t.State, t.Ended = "failed", time.Now()
+		if st.Reason == "aborted" {
+			t.State = "aborted"
+		}
+	}
+}
+
+// JSONTest is a Test as the API shows it.
+type JSONTest struct {
+	ID      string
+	State   string
+	Test    string
+	Host    string
+	Port    string
+	Created time.Time
+	Started *time.Time `json:",omitempty"`
+	Ended   *time.Time `json:",omitempty"`
+	Stats   *JSONStats `json:",omitempty"` // the latest
+}
+
+func jsontest(t *Test) JSONTest {
+	jt := JSONTest{ID: t.ID, State: t.State, Test: t.Cmd.Name, Host: t.Cmd.Cfg.Host, Port: t.Cmd.Cfg.RPCPort,
+		Created: t.Created}
+	if !t.Started.IsZero() {
+		jt.Started = &t.Started
+	}
+	if !t.Ended.IsZero() {
+		jt.Ended = &t.Ended
+	}
+	if t.Last.Stat != "" {
+		st := jsonstats(&t.Last)
+		jt.Stats = &st
+	}
+	return jt
+}
+
+// APIError is the body of an API error response.
+type APIError struct {
+	Error   string
+	Details []string `json:",omitempty"`
+}
+
+// APIHandler serves the JSON API for tests at /api/v1/tests:
+//
+//	POST   /api/v1/tests       queue the test described by a Job; 201 with its id
+//	GET    /api/v1/tests       list the tests
+//	GET    /api/v1/tests/{id}  the state and latest stats of a test
+//	DELETE /api/v1/tests/{id}  abort a queued or running test
+type APIHandler struct {
+	T *Tests
+}
+
+const apiTests = "/api/v1/tests"
+
+func (ah *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, apiTests), "/")
+	switch {
+	case id == "" && r.Method == "POST":
+		ah.submit(w, r)
+	case id == "" && r.Method == "GET":
+		l := ah.T.List()
+		js := make([]JSONTest, 0, len(l))
+		for i := range l {
+			js = append(js, jsontest(&l[i]))
+		}
+		reply(w, http.StatusOK, js)
+	case id != "" && r.Method == "GET":
+		t, ok := ah.T.Get(id)
+		if !ok {
+			reply(w, http.StatusNotFound, APIError{Error: "no such test: " + id})
+			return
+		}
+		reply(w, http.StatusOK, jsontest(&t))
+	case id != "" && r.Method == "DELETE":
+		if _, ok := ah.T.Get(id); !ok {
+			reply(w, http.StatusNotFound, APIError{Error: "no such test: " + id})
+			return
+		}
+		t, ok := ah.T.Abort(id)
+		if !ok {
+			reply(w, http.StatusConflict, APIError{Error: "test already finished: " + id})
+			return
+		}
+		reply(w, http.StatusAccepted, jsontest(&t))
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		reply(w, http.StatusMethodNotAllowed, APIError{Error: r.Method + " not allowed on " + r.URL.Path})
+	}
+}
+
+func (ah *APIHandler) submit(w http.ResponseWriter, r *http.Request) {
+	var j Job
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&j); err != nil {
+		reply(w, http.StatusBadRequest, APIError{Error: "bad request body", Details: []string{err.Error()}})
+		return
+	}
+	c, err := j.Command()
+	if err != nil {
+		reply(w, http.StatusBadRequest, APIError{Error: "invalid test", Details: err.(JobError)})
+		return
+	}
+	t, err := ah.T.Submit(c, sessionid(r))
+	if err != nil {
+		reply(w, http.StatusServiceUnavailable, APIError{Error: err.Error()})
+		return
+	}
+	log.Println("API: test ", t.ID, " ", c.Name, " ", c.Cfg.Host)
+	w.Header().Set("Location", apiTests+"/"+t.ID)
+	reply(w, http.StatusCreated, jsontest(&t))
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
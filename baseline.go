@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// default allowed shortfall from a baseline
+const defTol = 0.1
+
+// Baseline is what new results of a server and test are held to: either
+// the result of one run, or the average of the Window runs before each new one.
+type Baseline struct {
+	Host   string
+	Test   string
+	Run    string  // ID of the reference run
+	Window int     // or the number of recent runs to average
+	Tol    float64 // allowed relative shortfall; 0.1 is 10%
+}
+
+// Regression tells how far a result fell short of its baseline. Ref and Got
+// are in bits per second for UP and DOWN tests and in transactions per
+// second otherwise.
+type Regression struct {
+	Ref  float64
+	Got  float64
+	Drop float64 // (Ref-Got)/Ref
+	Tol  float64
+}
+
+// Baselines keeps the baseline of each server and test in a JSON file and
+// checks results against them.
+type Baselines struct {
+	mu   sync.Mutex
+	path string
+	h    *History
+	bs   map[string]Baseline
+}
+
+// baselines checks every completed test; see LogClient.
+var baselines *Baselines
+
+func blkey(host, test string) string {
+	return host + " " + test
+}
+
+// OpenBaselines reads the baselines in the file at path, if it exists, for
+// results in the history h.
+func OpenBaselines(path string, h *History) (*Baselines, error) {
+	b := &Baselines{path: path, h: h, bs: make(map[string]Baseline)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var bs []Baseline
+	if err = json.NewDecoder(f).Decode(&bs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, x := range bs {
+		b.bs[blkey(x.Host, x.Test)] = x
+	}
+	return b, nil
+}
+
+// save rewrites the file; b.mu must be held.
+func (b *Baselines) save() error {
+	bs := make([]Baseline, 0, len(b.bs))
+	for _, x := range b.bs {
+		bs = append(bs, x)
+	}
+	tmp := b.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// List returns all baselines.
+func (b *Baselines) List() []Baseline {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bs := make([]Baseline, 0, len(b.bs))
+	for _, x := range b.bs {
+		bs = append(bs, x)
+	}
+	return bs
+}
+
+// Set makes x the baseline of its server and test. A baseline on a run
+// takes its server and test from the run.
+func (b *Baselines) Set(x Baseline) (Baseline, error) {
+	if x.Run != "" {
+		r, ok, err := b.h.Get(x.Run)
+		if err != nil {
+			return x, err
+		}
+		if !ok {
+			return x, errors.New("no such run: " + x.Run)
+		}
+		x.Host, x.Test, x.Window = r.Sum.Cfg.Host, r.Test, 0
+	} else if x.Window < 1 || x.Host == "" || x.Test == "" {
+		return x, errors.New("a baseline needs a run, or a host, test and window")
+	}
+	if !validhost(x.Host) {
+		return x, errors.New("bad host: " + x.Host)
+	}
+	switch x.Test {
+	case "UP", "DOWN", "CRR", "RR":
+	default:
+		return x, errors.New("bad test: " + x.Test)
+	}
+	if x.Tol <= 0 {
+		x.Tol = defTol
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bs[blkey(x.Host, x.Test)] = x
+	return x, b.save()
+}
+
+// validhost reports whether h is an IP address or a host name.
+func validhost(h string) bool {
+	if net.ParseIP(h) != nil {
+		return true
+	}
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(h, ".") {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Clear removes the baseline of a server and test.
+func (b *Baselines) Clear(host, test string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bs, blkey(host, test))
+	return b.save()
+}
+
+// value is the figure of merit of a result
+func value(sm *stats.Summary) float64 {
+	if sm.Lat != nil {
+		return sm.TPS
+	}
+	return float64(sm.Avg)
+}
+
+// Check compares a new result, not yet in the history, with its baseline.
+// It returns nil if there is no baseline or the result is within tolerance.
+func (b *Baselines) Check(test string, sm *stats.Summary) *Regression {
+	b.mu.Lock()
+	x, ok := b.bs[blkey(sm.Cfg.Host, test)]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var ref float64
+	if x.Run != "" {
+		r, ok, err := b.h.Get(x.Run)
+		if err != nil || !ok {
+			log.Println("baseline: run ", x.Run, " not found ", err)
+			return nil
+		}
+		ref = value(&r.Sum)
+	} else {
+		rs, err := b.h.Find(Filter{Host: x.Host, Test: x.Test})
+		if err != nil || len(rs) == 0 {
+			return nil
+		}
+		if len(rs) > x.Window {
+			rs = rs[len(rs)-x.Window:]
+		}
+		for i := range rs {
+			ref += value(&rs[i].Sum)
+		}
+		ref /= float64(len(rs))
+	}
+	if ref <= 0 {
+		return nil
+	}
+	got := value(sm)
+	drop := (ref - got) / ref
+	if drop <= x.Tol {
+		return nil
+	}
+	return &Regression{Ref: ref, Got: got, Drop: drop, Tol: x.Tol}
+}
+
+// BaseHandler manages baselines over http at /baseline. GET lists them;
+// POST sets one from either the id of a run, or host, test and window
+// (a number of runs), with an optional tolerance tol in percent; DELETE
+// with host and test removes one.
+type BaseHandler struct {
+	B *Baselines
+}
+
+func (bh *BaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	switch r.Method {
+	case "GET":
+		v = bh.B.List()
+	case "POST":
+		x := Baseline{Run: r.FormValue("id"), Host: r.FormValue("host"), Test: r.FormValue("test")}
+		if s := r.FormValue("window"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "bad window: "+s, http.StatusBadRequest)
+				return
+			}
+			x.Window = n
+		}
+		if s := r.FormValue("tol"); s != "" {
+			t, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				http.Error(w, "bad tol: "+s, http.StatusBadRequest)
+				return
+			}
+			x.Tol = t / 100
+		}
+		var err error
+		if x, err = bh.B.Set(x); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Baseline set: ", x)
+		v = x
+	case "DELETE":
+		if err := bh.B.Clear(r.FormValue("host"), r.FormValue("test")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = bh.B.List()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
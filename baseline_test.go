@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBaselineSetHost(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(filepath.Join(dir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenBaselines(filepath.Join(dir, "baseline"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"lab1", "lab-2.example.com", "10.0.0.1", "::1"} {
+		if _, err := b.Set(Baseline{Host: host, Test: "UP", Window: 5}); err != nil {
+			t.Errorf("Set of host %q: %v", host, err)
+		}
+	}
+	for _, host := range []string{"<img src=x onerror=alert(1)>", "a b", "-lab", "lab..x", "'"} {
+		if _, err := b.Set(Baseline{Host: host, Test: "UP", Window: 5}); err == nil {
+			t.Errorf("Set of host %q succeeded", host)
+		}
+	}
+	if _, err := b.Set(Baseline{Host: "lab1", Test: "<b>", Window: 5}); err == nil {
+		t.Error("Set of a made up test succeeded")
+	}
+}
@@ -1,291 +1,173 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"net"
-	"net/rpc"
-	"time"
-)
-
-type TCPWorker interface {
-	GetName() string
-	Work(stop <-chan bool, stats chan<- uint64, nbytes uint64, addr string)
-	GetRPC() string
-}
-
-// Type TCPSender implements TCPWorker interface for Upload speed test
-// It contains the name of the server side RPC function to call to initiate testing
-type TCPSender string
-
-func (s TCPSender) GetName() string {
-	return "UP"
-}
+	"strings"
+	"sync"
 
-func (s TCPSender) GetRPC() string {
-	return string(s)
-}
-
-// TCPSender Work method uploads nbyte bytes to tcp address addr; if it receives anything on
-// the stop channel sch, it exits. it periodically reports the number of bytes it
-// transfered since the last report on cch
-func (s TCPSender) Work(sch <-chan bool, cch chan<- uint64, nbytes uint64, addr string) {
-	defer close(cch) // to signal the launcher we exited
-
-	pktsize := uint64(8 * 1024)
-	every := uint64(16 * pktsize)
-
-	buf := make([]byte, pktsize)
+	"github.com/9nut/tcpmeter/client"
+)
 
-	log.Println("About to dial ", addr)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer conn.Close()
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	incr := pktsize
-	nw := 0
+// TCPClient initiates Upload, Download or RTT measurements, based on
+// the instructions sent to it over the Command chan and reports back
+// its results over Stats chan. Tests of different servers run at the
+// same time; those of one server run one after another, as they would
+// skew each other and the server serves one at a time.
+func TCPClient(cch <-chan Command, sch chan<- Stats) {
+	log.Println("TCPClient started")
 
-	for n := uint64(0); n < nbytes; n += uint64(nw) {
-		if nbytes-n < pktsize {
-			incr = nbytes - n
-			buf = buf[:incr]
+	var wg sync.WaitGroup
+	queues := make(map[string]chan Command)
+	for c := range cch {
+		log.Println("Command: ", c.Name, " ", c.Cfg.Host)
+		if c.Name == "STOP" {
+			continue
 		}
-		nw, err = conn.Write(buf)
-		if err != nil {
-			log.Println(err)
-			return
-		} else if nw != len(buf) {
-			log.Println("Short write")
-			return
-		} else {
-			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		key := c.Cfg.Host + ":" + c.Cfg.RPCPort
+		q, ok := queues[key]
+		if !ok {
+			q = make(chan Command, maxQueued)
+			queues[key] = q
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runqueue(q, sch)
+			}()
 		}
+		q <- c
+	}
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+	close(sch)
+}
+
+// runqueue runs the tests of one server in turn, skipping those aborted
+// while they waited.
+func runqueue(q <-chan Command, sch chan<- Stats) {
+	for c := range q {
 		select {
-		case <-sch:
-			return
+		case <-c.Abort:
+			continue
 		default:
-			if (n+incr)%every == 0 {
-				cch <- every
-			}
+		}
+		if err := Run(sch, c); err != nil {
+			log.Println(err)
+			sch <- failstats(c, err)
 		}
 	}
-	cch <- incr
 }
 
-// Type TCPReceiver implements TCPWorker interface for Download speed test
-// It contains the name of the server side RPC function to call to initiate testing
-type TCPReceiver string
-
-func (r TCPReceiver) GetName() string {
-	return "DOWN"
+// failstats is the Stats that reports the failure of c.
+func failstats(c Command, err error) Stats {
+	return Stats{ID: c.ID, Stat: "Error", Type: c.Name, Host: c.Cfg.Host, Reason: failreason(err), Err: err.Error()}
 }
 
-func (r TCPReceiver) GetRPC() string {
-	return string(r)
-}
-
-// TCPReceiver Work method downloads nbyte bytes from tcp address addr; if it receives
-// anything on the stop channel sch, it exits. it periodically reports the number of bytes
-// it received since the last report on cch
-func (r TCPReceiver) Work(sch <-chan bool, cch chan<- uint64, nbytes uint64, addr string) {
-	defer close(cch) // to signal the launcher we exited
-
-	pktsize := uint64(8 * 1024)
-	every := uint64(16 * pktsize)
-
-	buf := make([]byte, pktsize)
-
-	log.Println("About to dial ", addr)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println(err)
-		return
+// Run performs the measurement that c asks for, reporting on sch. Closing
+// c.Abort ends it with context.Canceled.
+func Run(sch chan<- Stats, c Command) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.Abort != nil {
+		go func() {
+			select {
+			case <-c.Abort:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
 	}
-	defer conn.Close()
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	nw := 0
-	chkpt := uint64(0)
-
-L:
-	for n := uint64(0); n < nbytes; n += uint64(nw) {
-		nw, err = conn.Read(buf)
-		if err != nil {
-			log.Println(err)
-			return
-		} else {
-			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		}
-		chkpt += uint64(nw)
+	opt := client.Options{Test: c.Name, Config: c.Cfg, Progress: func(p client.Progress) {
 		select {
-		case <-sch:
-			break L
+		case sch <- Stats{ID: c.ID, Stat: "Running", Type: p.Test, Rate: p.Rate, Steady: p.Steady, TPS: p.TPS}:
 		default:
-			if chkpt >= every {
-				cch <- chkpt
-				chkpt = 0
-			}
 		}
+	}, Logf: logf}
+	res, err := client.Measure(ctx, opt)
+	if res.Elapsed > 0 {
+		sum := res.Summary
+		sch <- Stats{ID: c.ID, Stat: "Done", Type: res.Test, Rate: sum.Avg, Steady: res.Steady, TPS: sum.TPS, Sum: &sum}
 	}
-	cch <- chkpt
+	return err
 }
 
-func Dispatch(ch chan<- Stats, cfg SrvConfig, worker TCPWorker) error {
-	name := worker.GetName()
-
-	log.Println("Measuring ", name, " speed...")
-	client, err := rpc.Dial("tcp", cfg.Host+":"+cfg.RPCPort)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer client.Close()
-
-	Done := make(chan bool)
-	Res := make(chan uint64)
-	samples := make([]BitRate, 1, 21)
-	var (
-		rep      bool
-		addr     string
-		tcnt     uint64
-		lcnt     uint64
-		srvtotal uint64
-		br       BitRate
-	)
-
-	err = client.Call("TCPPerf.TCPStart", 0, &addr)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	log.Println("Payload address: ", addr)
-
-	rpcname := worker.GetRPC()
-	log.Println("Calling ", rpcname, " ...")
-	aRcv := client.Go(rpcname, cfg.Count, &srvtotal, nil)
-
-	go worker.Work(Done, Res, cfg.Count, cfg.Host+":"+addr)
-
-	log.Println("Entering wait loop")
-	t0 := time.Now()
-	t1 := t0
-	bps := func(n uint64, t0, t1 time.Time) BitRate {
-		// n*8 bits
-		return BitRate(n * uint64(8e9) / uint64(t1.Sub(t0).Nanoseconds()))
-	}
-	avg := func(s []BitRate) BitRate {
-		t := uint64(0)
-		for _, x := range s {
-			t += uint64(x)
-		}
-		return BitRate(t / uint64(len(s)))
-	}
-	addsamp := func() {
-		tn := time.Now()
-		xr := bps(lcnt, t1, tn)
-		lcnt = uint64(0)
-		t1 = tn
-		samples = append(samples, xr)
-		if len(samples) > 20 {
-			samples = samples[len(samples)-20:]
+// RunOnce runs c without the web UI and prints its summary. It returns the
+// exit status of the program: 0 if the test went well, 1 if it failed and
+// 2 if it fell short of its baseline.
+func RunOnce(c Command) int {
+	sch := make(chan Stats, 10)
+	ech := make(chan error, 1)
+	go func() {
+		ech <- Run(sch, c)
+		close(sch)
+	}()
+
+	status := 1
+	for st := range sch {
+		note(&st)
+		sm := st.Sum
+		if sm == nil {
+			continue
 		}
-	}
-	timer := time.Tick(500 * time.Millisecond)
-
-L1:
-	for {
-		select {
-		case <-timer:
-			addsamp()
-			br = avg(samples)
-			// log.Println("Bitrate: ", br.Mbps(), " Mbps, samples:", len(samples))
-			if tcnt >= cfg.Count {
-				Done <- true
-				break L1
-			}
-			select {
-			case ch <- Stats{"Running", name, br}:
-			default:
-			}
-		case count, ok := <-Res:
-			if ok {
-				tcnt += count
-				lcnt += count
-			} else {
-				addsamp()
-				br = avg(samples)
-				// log.Println("Bitrate: ", br.Mbps(), " Mbps")
-				break L1
+		status = 0
+		fmt.Printf("%s %s:%s\n", c.Name, c.Cfg.Host, c.Cfg.RPCPort)
+		fmt.Printf("elapsed\t%.3fs\n", sm.Elapsed.Seconds())
+		if l := sm.Lat; l != nil {
+			fmt.Printf("transactions\t%d\nrate\t%.1f/s\n", sm.Txns, sm.TPS)
+			fmt.Printf("latency\tmin %v p50 %v p90 %v p99 %v p99.9 %v max %v\n",
+				l.Min, l.P50, l.P90, l.P99, l.P999, l.Max)
+		} else {
+			fmt.Printf("bytes\t%d (server %d)\n", sm.Bytes, sm.SrvBytes)
+			fmt.Printf("average\t%.2f Mbps\npeak\t%.2f Mbps\nmin\t%.2f Mbps\nstddev\t%.2f Mbps\n",
+				sm.Avg.Mbps(), sm.Peak.Mbps(), sm.Min.Mbps(), sm.StdDev.Mbps())
+			fmt.Printf("sender\t%.2f Mbps\nreceiver\t%.2f Mbps\n", sm.Send.Mbps(), sm.Recv.Mbps())
+			if len(sm.SrvCPU) > 0 {
+				fmt.Printf("server cpu\t%s\n", cpus(sm.SrvCPU))
 			}
 		}
+		if rg := st.Regr; rg != nil {
+			fmt.Printf("REGRESSION\t%.1f%% below baseline (tolerance %.1f%%)\n", rg.Drop*100, rg.Tol*100)
+			status = 2
+		}
 	}
-
-	ch <- Stats{"Running", name, br}
-
-	<-aRcv.Done
-	br = bps(tcnt, t0, time.Now())
-	log.Println("My count: ", cfg.Count, " Server count: ", srvtotal, " Average: ", br.Mbps(), "Mbps")
-
-	err = client.Call("TCPPerf.TCPStop", 0, &rep)
+	err := <-ech
 	if err != nil {
-		log.Println(err)
-	}
-	return err
-
-}
-
-// TCPClient initiates Upload, Download or RTT measurements, based on
-// the instructions sent to it over the Command chan and reports back
-// its results over Stats chan.
-func TCPClient(cch <-chan Command, sch chan<- Stats) {
-	log.Println("TCPClient started")
-
-	ops := map[string]TCPWorker{
-		"UP":   TCPSender("TCPPerf.TCPRcv"),
-		"DOWN": TCPReceiver("TCPPerf.TCPSnd"),
+		st := failstats(c, err)
+		note(&st)
+		fmt.Println("error:", err)
+		status = 1
 	}
-
-	timer := time.Tick(1 * time.Second)
-L:
-	for {
-		select {
-		case c, ok := (<-cch):
-			if !ok {
-				close(sch)
-				break L
-			}
-			log.Println("Command: ", c.Name)
-			worker, found := ops[c.Name]
-			if found {
-				err := Dispatch(sch, c.Cfg, worker)
-				if err != nil {
-					log.Println(err)
-				}
-			} else if c.Name != "STOP" {
-				log.Println("Unsupported command:", c.Name)
-				select {
-				case sch <- Stats{Stat: "Error", Type: "Illegal command:" + c.Name}:
-				default:
-				}
-			}
-		case <-timer:
-			select {
-			case sch <- Stats{Stat: "Stopped"}:
-			default:
-			}
-		}
+	if alerts != nil {
+		alerts.Wait()
 	}
+	return status
 }
 
-func ClientMain(haddr string) {
+// ClientMain runs the client and its web UI, and the schedule if
+// there is one.
+func ClientMain(haddr string, sched *Schedule) {
 	cch := make(chan Command)
 	sch := make(chan Stats, 10)
-	lch := make(chan Stats)
+	hub := NewHub()
 	go TCPClient(cch, sch)
-	go LogClient(sch, lch)
+	if sched != nil {
+		go Scheduler(sched, cch)
+	}
+	tests = NewTests(cch)
+	clientmetrics()
+	go LogClient(sch, hub)
 	fmt.Printf("Open http://localhost%s in a browser\n", haddr)
-	WebUI(haddr, cch, lch)
+	WebUI(haddr, tests, hub)
+}
+
+// cpus formats the busy fractions of cores as percentages.
+func cpus(us []float64) string {
+	ps := make([]string, len(us))
+	for i, u := range us {
+		ps[i] = fmt.Sprintf("%.0f%%", u*100)
+	}
+	return strings.Join(ps, " ")
 }
@@ -0,0 +1,103 @@
+// Package client measures the throughput, connection rate or transaction
+// latency between this host and a tcpmeter server.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// Options describe a measurement.
+type Options struct {
+	Test string // UP, DOWN, CRR or RR
+	stats.Config
+
+	// Progress, if not nil, is called about every stats.Period while the
+	// test runs, and once more as a transfer ends. It is called from the
+	// measuring goroutine and should not block.
+	Progress func(Progress)
+
+	// Logf, if not nil, is given a trace of what the measurement does.
+	Logf func(format string, v ...any)
+}
+
+func (o *Options) progress(p Progress) {
+	if o.Progress != nil {
+		o.Progress(p)
+	}
+}
+
+// logln logs v through Logf in the manner of log.Println.
+func (o *Options) logln(v ...any) {
+	if o.Logf != nil {
+		o.Logf("%s", fmt.Sprintln(v...))
+	}
+}
+
+// Progress is the state of a running test.
+type Progress struct {
+	Test   string
+	Rate   stats.BitRate // moving average of UP and DOWN tests
+	Steady bool          // the rate has settled; see stats.Config.Steady
+	TPS    float64       // transactions per second, for CRR and RR tests
+}
+
+// Result is the outcome of a measurement.
+type Result struct {
+	Test   string
+	Steady bool // the rate settled before the test ended
+	stats.Summary
+}
+
+// ErrUnknownTest is returned by Measure for a test it doesn't know.
+var ErrUnknownTest = errors.New("unknown test")
+
+// ErrTxnSize is returned by Measure for an RR test whose request or
+// response is over stats.MaxTxn bytes, which no server takes.
+var ErrTxnSize = errors.New("transaction size out of range")
+
+// Measure runs the test that opt describes against the server at
+// opt.Host:opt.RPCPort and returns its result. It gives up with ctx.Err()
+// as soon as ctx is done. Other failures are returned as an *Error with
+// their Reason. A measurement that ran to the end but failed to tidy up
+// returns both its result and the error.
+func Measure(ctx context.Context, opt Options) (Result, error) {
+	workers := map[string]TCPWorker{
+		"UP":   TCPSender("TCPPerf.TCPRcv"),
+		"DOWN": TCPReceiver("TCPPerf.TCPSnd"),
+	}
+	txns := map[string]func(context.Context, Options) (Result, error){
+		"CRR": crrtest,
+		"RR":  rrtest,
+	}
+
+	var res Result
+	var err error
+	if worker, found := workers[opt.Test]; found {
+		res, err = stream(ctx, opt, worker)
+	} else if txn, found := txns[opt.Test]; found {
+		res, err = txn(ctx, opt)
+	} else {
+		opt.logln("Unsupported test:", opt.Test)
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownTest, opt.Test)
+	}
+	if err != nil && ctx.Err() != nil {
+		return Result{}, ctx.Err()
+	}
+	return res, err
+}
+
+// dial connects to the RPC port of the server of cfg.
+func dial(ctx context.Context, cfg stats.Config) (*rpc.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(cfg.Host, cfg.RPCPort))
+	if err != nil {
+		return nil, fail("connect", err)
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,324 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/9nut/tcpmeter/client"
+	"github.com/9nut/tcpmeter/impair"
+	"github.com/9nut/tcpmeter/server"
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// serve starts a server on the loopback whose payload goes through p both
+// ways, and returns its config.
+func serve(t *testing.T, p impair.Profile) stats.Config {
+	t.Helper()
+	srv := server.New(server.Options{Listen: func(network, addr string) (net.Listener, error) {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return impair.Listen(l, p, p), nil
+	}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return stats.Config{Host: host, RPCPort: port}
+}
+
+func TestMeasureRate(t *testing.T) {
+	const rate = 8 << 20 // bytes per second
+	cfg := serve(t, impair.Profile{Rate: rate})
+	cfg.Count = rate
+	want := float64(rate*8) / 1e6
+	for _, test := range []string{"UP", "DOWN"} {
+		res, err := client.Measure(context.Background(), client.Options{Test: test, Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: %v", test, err)
+		}
+		// the receiver's rate, as the sender's includes what the socket buffers took
+		if got := float64(res.Recv.Mbps()); got < want*0.85 || got > want*1.15 {
+			t.Errorf("%s at %.1f Mbps measured %.1f Mbps", test, want, got)
+		}
+	}
+}
+
+func TestMeasureStop(t *testing.T) {
+	const rate = 8 << 20
+	cfg := serve(t, impair.Profile{Rate: rate})
+	cfg.Count = 64 * rate // much longer than it takes to be steady
+	cfg.Steady, cfg.Stop = 0.2, true
+	for _, test := range []string{"UP", "DOWN"} {
+		res, err := client.Measure(context.Background(), client.Options{Test: test, Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: %v", test, err)
+		}
+		if !res.Steady || res.Skewed || res.Send == 0 && res.Recv == 0 {
+			t.Errorf("%s stopped once steady: steady %v, skewed %v, send %v, recv %v", test, res.Steady, res.Skewed, res.Send, res.Recv)
+		}
+	}
+}
+
+func TestMeasureDelay(t *testing.T) {
+	cfg := serve(t, impair.Profile{Delay: 5 * time.Millisecond})
+	cfg.Dur = time.Second
+	res, err := client.Measure(context.Background(), client.Options{Test: "RR", Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no less than the round trip, and not so much more that the delay
+	// can't be as set, on a busy machine
+	if p50 := res.Lat.P50; p50 < 10*time.Millisecond || p50 > 40*time.Millisecond {
+		t.Errorf("RR over 5ms each way measured a median of %v", p50)
+	}
+}
+
+func TestMeasureReset(t *testing.T) {
+	cfg := serve(t, impair.Profile{Reset: 1 << 20})
+	cfg.Count = 8 << 20
+	_, err := client.Measure(context.Background(), client.Options{Test: "DOWN", Config: cfg})
+	if r := client.ReasonOf(err); r != client.Reset {
+		t.Errorf("DOWN reset after 1MiB failed with %v (%s), want a reset", err, r)
+	}
+}
+
+func TestMeasureAbort(t *testing.T) {
+	cfg := serve(t, impair.Profile{Rate: 1 << 20})
+	cfg.Count = 64 << 20
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err := client.Measure(ctx, client.Options{Test: "UP", Config: cfg})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Measure: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("Measure took %v to give up", d)
+	}
+}
+
+func TestMeasureAbortTxn(t *testing.T) {
+	cfg := serve(t, impair.Profile{Delay: 2 * time.Second})
+	for _, test := range []string{"CRR", "RR"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		t0 := time.Now()
+		_, err := client.Measure(ctx, client.Options{Test: test, Config: cfg})
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("%s: %v, want %v", test, err, context.DeadlineExceeded)
+		}
+		if d := time.Since(t0); d > 2*time.Second {
+			t.Errorf("%s took %v to give up", test, d)
+		}
+	}
+}
+
+func TestMeasureConcurrent(t *testing.T) {
+	cfg := serve(t, impair.Profile{Rate: 8 << 20})
+	cfg.Count = 8 << 20
+	errs := make(chan error, 2)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := client.Measure(context.Background(), client.Options{Test: "UP", Config: cfg})
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("one of two tests at once: %v", err)
+		}
+	}
+}
+
+func TestMeasureCores(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT listeners are Linux only")
+	}
+	srv := server.New(server.Options{Cores: 4, Pin: true})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	cfg := stats.Config{Host: host, RPCPort: port, Count: 64 << 20, Dur: 500 * time.Millisecond}
+	for _, test := range []string{"UP", "DOWN", "CRR"} {
+		res, err := client.Measure(context.Background(), client.Options{Test: test, Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: %v", test, err)
+		}
+		switch {
+		case test == "CRR" && res.Txns == 0:
+			t.Errorf("CRR over 4 listeners made no connections")
+		case test != "CRR" && (res.SrvBytes != cfg.Count || len(res.SrvCPU) == 0):
+			t.Errorf("%s: server moved %d bytes, of %d, using %v of its cores", test, res.SrvBytes, cfg.Count, res.SrvCPU)
+		}
+	}
+}
+
+// TestServerSizes checks that the server turns down transactions too big
+// to allocate, rather than dying.
+func TestServerSizes(t *testing.T) {
+	cfg := serve(t, impair.Profile{})
+	c, err := rpc.Dial("tcp", net.JoinHostPort(cfg.Host, cfg.RPCPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var addr string
+	if err := c.Call("TCPPerf.TCPStart", 0, &addr); err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, sz := range []uint64{0, stats.MaxTxn + 1, 1 << 62} {
+		if err := c.Call("TCPPerf.TCPCrr", sz, &n); err == nil {
+			t.Errorf("TCPCrr of %d bytes succeeded", sz)
+		}
+		if err := c.Call("TCPPerf.TCPRR", stats.TxnSize{Req: sz, Resp: 1}, &n); err == nil {
+			t.Errorf("TCPRR of %d byte requests succeeded", sz)
+		}
+		if err := c.Call("TCPPerf.TCPRR", stats.TxnSize{Req: 1, Resp: sz}, &n); err == nil {
+			t.Errorf("TCPRR of %d byte responses succeeded", sz)
+		}
+	}
+	cfg.Req = 1 << 62
+	if _, err := client.Measure(context.Background(), client.Options{Test: "RR", Config: cfg}); !errors.Is(err, client.ErrTxnSize) {
+		t.Errorf("RR of %d byte requests: %v, want %v", cfg.Req, err, client.ErrTxnSize)
+	}
+}
+
+// TestServerAcceptTimeout checks that a transfer whose payload connection
+// never comes fails after the accept timeout, so that the server can shut
+// down.
+func TestServerAcceptTimeout(t *testing.T) {
+	srv := server.New(server.Options{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	c, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var addr string
+	if err := c.Call("TCPPerf.TCPStart", 0, &addr); err != nil {
+		t.Fatal(err)
+	}
+	var r stats.XferResult
+	call := c.Go("TCPPerf.TCPRcv", uint64(1<<20), &r, nil)
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			t.Error("TCPRcv without a payload connection succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("TCPRcv still waiting for its payload connection after 10s")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+// stuck is a server whose payload port doesn't accept and whose transfers
+// never end.
+type stuck struct {
+	port string
+	hang chan struct{}
+}
+
+func (s *stuck) TCPStart(_ int, r *string) error { *r = s.port; return nil }
+
+func (s *stuck) TCPStop(_ int, r *bool) error { *r = true; return nil }
+
+func (s *stuck) TCPRcv(_ uint64, r *stats.XferResult) error {
+	<-s.hang
+	return errors.New("no payload")
+}
+
+// TestMeasurePayloadDial checks that a test whose payload can't be
+// dialed fails as such, even if the server's call never returns.
+func TestMeasurePayloadDial(t *testing.T) {
+	// a port that nothing listens on
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pl.Addr().String())
+	pl.Close()
+	s := &stuck{port: port, hang: make(chan struct{})}
+	defer close(s.hang)
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("TCPPerf", s); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			rs.ServeConn(c)
+		}
+	}()
+	host, rport, _ := net.SplitHostPort(l.Addr().String())
+	cfg := stats.Config{Host: host, RPCPort: rport, Count: 1 << 20}
+
+	t0 := time.Now()
+	_, err = client.Measure(context.Background(), client.Options{Test: "UP", Config: cfg})
+	var e *client.Error
+	if !errors.As(err, &e) || e.Op != "payload" || e.Reason != client.Dial {
+		t.Errorf("UP to a closed payload port: %v, want a payload dial error", err)
+	}
+	if d := time.Since(t0); d > 10*time.Second {
+		t.Errorf("Measure took %v to give up", d)
+	}
+}
+
+// BenchmarkLoopback reports the most that UP and DOWN tests measure over
+// the loopback, where the tool itself is the bottleneck.
+func BenchmarkLoopback(b *testing.B) {
+	for _, test := range []string{"UP", "DOWN"} {
+		b.Run(test, func(b *testing.B) {
+			srv := server.New(server.Options{})
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			go srv.Serve(l)
+			defer srv.Shutdown(context.Background())
+			host, port, _ := net.SplitHostPort(l.Addr().String())
+			cfg := stats.Config{Host: host, RPCPort: port, Count: 4 << 30}
+
+			var best stats.BitRate
+			b.SetBytes(int64(cfg.Count))
+			for i := 0; i < b.N; i++ {
+				res, err := client.Measure(context.Background(), client.Options{Test: test, Config: cfg})
+				if err != nil {
+					b.Fatal(err)
+				}
+				best = max(best, res.Avg)
+			}
+			b.ReportMetric(best.Mbps()/1000, "Gbps")
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"syscall"
+)
+
+// Reason is why a test failed.
+type Reason string
+
+const (
+	Aborted    Reason = "aborted"     // its context was canceled
+	Dial       Reason = "dial"        // the server couldn't be reached
+	Timeout    Reason = "timeout"     // the server or the path stopped answering
+	ShortWrite Reason = "short write" // a payload write was cut short
+	Reset      Reason = "reset"       // the connection was reset or closed early
+	Server     Reason = "server"      // the server reported an error
+	Network    Reason = "network"     // any other network error
+	Other      Reason = "other"
+)
+
+// Error is the failure of a test: what it was doing and why it failed.
+type Error struct {
+	Op     string // connect, payload, send, receive or the RPC method called
+	Reason Reason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// fail returns err, if it isn't nil or already an *Error, as an *Error of op.
+func fail(op string, err error) error {
+	var e *Error
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, Reason: ReasonOf(err), Err: err}
+}
+
+// ReasonOf classifies err, which may come from either end of a test.
+func ReasonOf(err error) Reason {
+	var e *Error
+	var ne net.Error
+	var oe *net.OpError
+	var se rpc.ServerError
+	switch {
+	case errors.As(err, &e):
+		return e.Reason
+	case errors.Is(err, context.Canceled):
+		return Aborted
+	case errors.Is(err, context.DeadlineExceeded):
+		return Timeout
+	case errors.As(err, &oe) && oe.Op == "dial":
+		return Dial
+	case errors.As(err, &ne) && ne.Timeout():
+		return Timeout
+	case errors.Is(err, io.ErrShortWrite):
+		return ShortWrite
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, rpc.ErrShutdown):
+		return Reset
+	case errors.As(err, &se):
+		return Server
+	case errors.As(err, &oe):
+		return Network
+	}
+	return Other
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+const window = 20 // intervals in the moving average
+
+// clock tells a sampler the time.
+type clock interface {
+	Now() time.Time
+}
+
+type sysclock struct{}
+
+func (sysclock) Now() time.Time { return time.Now() }
+
+// sampler turns the byte counts of a stream into the rates of intervals,
+// their moving average and the stream's summary. Its clock starts the
+// first interval when it is made and ends one at every sample.
+type sampler struct {
+	clock clock
+	omit  time.Duration // warm-up
+
+	t0   time.Time // start
+	t1   time.Time // end of the last interval
+	tw   time.Time // end of the warm-up
+	warm bool
+
+	total   uint64
+	last    uint64 // since t1
+	omitted uint64 // during the warm-up
+
+	cur   stats.BitRate   // of the last interval
+	avg   []stats.BitRate // latest interval rates after the warm-up
+	ivals []stats.BitRate // interval rates after the warm-up
+	tl    []stats.Interval
+}
+
+func newsampler(c clock, omit time.Duration) *sampler {
+	t := c.Now()
+	return &sampler{clock: c, omit: omit, t0: t, t1: t, tw: t.Add(omit), warm: omit > 0}
+}
+
+// add counts n bytes.
+func (s *sampler) add(n uint64) {
+	s.total += n
+	s.last += n
+	if s.warm {
+		s.omitted += n
+	}
+}
+
+// sample ends an interval. If no time has passed since the last, the bytes
+// counted are left to the next.
+func (s *sampler) sample() {
+	now := s.clock.Now()
+	if !now.After(s.t1) {
+		return
+	}
+	r := stats.Rate(s.last, now.Sub(s.t1))
+	s.tl = append(s.tl, stats.Interval{At: now.Sub(s.t0), Bytes: s.last})
+	s.last = 0
+	s.t1 = now
+	s.cur = r
+	if !s.warm {
+		s.ivals = append(s.ivals, r)
+	}
+	s.avg = append(s.avg, r)
+	if len(s.avg) > window {
+		s.avg = s.avg[len(s.avg)-window:]
+	}
+	if s.warm && !now.Before(s.tw) {
+		// warm-up is over; forget the slow start intervals
+		s.warm = false
+		s.tw = now
+		s.avg = s.avg[:0]
+	}
+}
+
+// rate is the moving average of the latest intervals, or the rate of the
+// last if none has ended since the warm-up.
+func (s *sampler) rate() stats.BitRate {
+	if len(s.avg) == 0 {
+		return s.cur
+	}
+	return stats.Mean(s.avg)
+}
+
+// steady reports whether the warm-up is over and the latest intervals
+// vary by less than cv.
+func (s *sampler) steady(cv float64) bool {
+	return !s.warm && steady(s.avg, cv)
+}
+
+// summary summarizes the stream up to now: its bytes, the time and
+// average rate after any warm-up, the spread of its intervals and its
+// timeline, to which the bytes counted since the last interval are added.
+// It also returns the average rate of the whole stream.
+func (s *sampler) summary() (stats.Summary, stats.BitRate) {
+	now := s.clock.Now()
+	if s.last > 0 {
+		// counted as the last interval ended
+		if n := len(s.tl); n > 0 {
+			s.tl[n-1].Bytes += s.last
+		} else {
+			s.tl = append(s.tl, stats.Interval{At: s.t1.Sub(s.t0), Bytes: s.last})
+		}
+		s.last = 0
+	}
+	sum := stats.Summary{Bytes: s.total, Timeline: s.tl}
+	whole := stats.Rate(s.total, now.Sub(s.t0))
+	if s.omit > 0 && !s.warm && now.After(s.tw) {
+		sum.Elapsed = now.Sub(s.tw)
+		sum.Avg = stats.Rate(s.total-s.omitted, sum.Elapsed)
+	} else {
+		sum.Elapsed = now.Sub(s.t0)
+		sum.Avg = whole
+	}
+	sum.Peak, sum.Min, sum.StdDev = spread(s.ivals)
+	return sum, whole
+}
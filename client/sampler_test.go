@@ -0,0 +1,187 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// fakeclock is a clock that moves only when told to.
+type fakeclock struct {
+	t time.Time
+}
+
+func (c *fakeclock) Now() time.Time { return c.t }
+
+func (c *fakeclock) tick(d time.Duration) { c.t = c.t.Add(d) }
+
+func newfake() *fakeclock {
+	return &fakeclock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+const mb = 1000000 // bytes
+
+func TestSamplerIntervals(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	for i := uint64(1); i <= 3; i++ {
+		s.add(i * mb)
+		c.tick(time.Second)
+		s.sample()
+	}
+	// 8, 16 and 24 Mbps
+	if r := s.rate(); r != 16*mb {
+		t.Errorf("moving average %v, want %v", r, 16*mb)
+	}
+	sum, whole := s.summary()
+	want := []stats.Interval{{At: time.Second, Bytes: mb}, {At: 2 * time.Second, Bytes: 2 * mb}, {At: 3 * time.Second, Bytes: 3 * mb}}
+	if len(sum.Timeline) != len(want) {
+		t.Fatalf("timeline %v, want %v", sum.Timeline, want)
+	}
+	for i := range want {
+		if sum.Timeline[i] != want[i] {
+			t.Errorf("interval %d is %v, want %v", i, sum.Timeline[i], want[i])
+		}
+	}
+	if sum.Bytes != 6*mb || sum.Elapsed != 3*time.Second || sum.Avg != 16*mb || whole != 16*mb {
+		t.Errorf("summary %d bytes in %v at %v (whole %v), want %d in 3s at %v", sum.Bytes, sum.Elapsed, sum.Avg, whole, 6*mb, 16*mb)
+	}
+	if sum.Peak != 24*mb || sum.Min != 8*mb {
+		t.Errorf("peak %v and min %v, want %v and %v", sum.Peak, sum.Min, 24*mb, 8*mb)
+	}
+}
+
+func TestSamplerZeroInterval(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	s.add(mb)
+	s.sample() // no time has passed
+	if len(s.tl) != 0 || s.rate() != 0 {
+		t.Errorf("an interval of no length made %v at %v", s.tl, s.rate())
+	}
+	c.tick(time.Second)
+	s.add(mb)
+	s.sample()
+	s.sample()
+	if len(s.tl) != 1 || s.tl[0].Bytes != 2*mb || s.rate() != 16*mb {
+		t.Errorf("timeline %v at %v, want 2MB in an interval at %v", s.tl, s.rate(), 16*mb)
+	}
+	if r := stats.Rate(mb, 0); r != 0 {
+		t.Errorf("rate of no time is %v", r)
+	}
+}
+
+func TestSamplerLateCount(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	s.add(mb)
+	c.tick(time.Second)
+	s.sample()
+	s.add(mb) // at the instant the interval ended
+	sum, _ := s.summary()
+	if len(sum.Timeline) != 1 || sum.Timeline[0].Bytes != 2*mb {
+		t.Errorf("timeline %v, want 2MB in one interval", sum.Timeline)
+	}
+	if sum.Bytes != 2*mb || sum.Avg != 16*mb {
+		t.Errorf("summary %d bytes at %v, want %d at %v", sum.Bytes, sum.Avg, 2*mb, 16*mb)
+	}
+}
+
+func TestSamplerNoTime(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	s.add(mb)
+	s.sample()
+	sum, whole := s.summary()
+	if sum.Bytes != mb || sum.Elapsed != 0 || sum.Avg != 0 || whole != 0 {
+		t.Errorf("summary %d bytes in %v at %v (whole %v), want %d in 0s at 0", sum.Bytes, sum.Elapsed, sum.Avg, whole, mb)
+	}
+	if len(sum.Timeline) != 1 || sum.Timeline[0] != (stats.Interval{At: 0, Bytes: mb}) {
+		t.Errorf("timeline %v, want 1MB at 0", sum.Timeline)
+	}
+}
+
+func TestSamplerWarmup(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, time.Second)
+	for i, n := range []uint64{mb / 2, mb / 2, 2 * mb, 2 * mb} {
+		s.add(n)
+		c.tick(stats.Period)
+		s.sample()
+		// until an interval ends after the warm-up, the rate is the last
+		if r := s.rate(); i == 1 && (r != 8*mb || s.steady(1)) {
+			t.Errorf("as the warm-up ends: %v, steady %v, want %v and not steady", r, s.steady(1), 8*mb)
+		}
+	}
+	// the warm-up ended with the second interval, after which the
+	// average starts
+	if r := s.rate(); r != 32*mb {
+		t.Errorf("moving average %v, want only the intervals after warm-up at %v", r, 32*mb)
+	}
+	c.tick(stats.Period)
+	sum, whole := s.summary()
+	if sum.Elapsed != 1500*time.Millisecond || sum.Avg != stats.Rate(4*mb, 1500*time.Millisecond) {
+		t.Errorf("after warm-up %v at %v, want 1.5s at %v", sum.Elapsed, sum.Avg, stats.Rate(4*mb, 1500*time.Millisecond))
+	}
+	if whole != stats.Rate(5*mb, 2500*time.Millisecond) {
+		t.Errorf("whole stream at %v, want %v", whole, stats.Rate(5*mb, 2500*time.Millisecond))
+	}
+	if sum.Peak != 32*mb || sum.Min != 32*mb || sum.StdDev != 0 {
+		t.Errorf("spread %v-%v ± %v, want only the intervals after warm-up", sum.Min, sum.Peak, sum.StdDev)
+	}
+}
+
+func TestSamplerEndsInWarmup(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 10*time.Second)
+	s.add(mb)
+	c.tick(time.Second)
+	s.sample()
+	sum, _ := s.summary()
+	if sum.Elapsed != time.Second || sum.Avg != 8*mb {
+		t.Errorf("stream shorter than its warm-up: %v at %v, want 1s at %v", sum.Elapsed, sum.Avg, 8*mb)
+	}
+	if s.steady(1) {
+		t.Error("steady during warm-up")
+	}
+}
+
+func TestSamplerWindow(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	for i := 0; i < window+steadyN; i++ {
+		if i < steadyN {
+			s.add(10 * mb)
+		} else {
+			s.add(mb)
+		}
+		c.tick(time.Second)
+		s.sample()
+	}
+	if r := s.rate(); r != 8*mb {
+		t.Errorf("moving average %v, want only the latest %d intervals at %v", r, window, 8*mb)
+	}
+	if !s.steady(0.01) {
+		t.Error("not steady at a constant rate")
+	}
+}
+
+func TestSamplerTerabytes(t *testing.T) {
+	c := newfake()
+	s := newsampler(c, 0)
+	// 100 Gbps for an hour, in half second intervals
+	per := uint64(100e9 / 8 / 2)
+	for i := 0; i < 7200; i++ {
+		s.add(per)
+		c.tick(stats.Period)
+		s.sample()
+	}
+	sum, whole := s.summary()
+	if sum.Bytes != 45e12 || sum.Avg != 100e9 || whole != 100e9 {
+		t.Errorf("%d bytes at %v (whole %v), want %d at %v", sum.Bytes, sum.Avg, whole, uint64(45e12), uint64(100e9))
+	}
+	if s.rate() != 100e9 || sum.Peak != 100e9 || sum.Min != 100e9 {
+		t.Errorf("intervals at %v, from %v to %v, want %v", s.rate(), sum.Min, sum.Peak, uint64(100e9))
+	}
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+	"github.com/9nut/tcpmeter/xfer"
+)
+
+// number of half second samples that must agree before the rate is
+// declared steady
+const steadyN = 6
+
+// largest relative difference between sender and receiver side rates
+// before it is flagged as buffering in the path
+const maxSkew = 0.1
+
+// longest wait for the server's call to end after a payload that failed,
+// once TCPStop has closed its listener
+const stopWait = 5 * time.Second
+
+// TCPWorker moves the payload of an UP or DOWN test.
+type TCPWorker interface {
+	GetName() string
+	// Work moves nbytes to or from tcp address addr, in reads or writes
+	// of at most buf bytes, and adds what it has moved to moved as it
+	// goes. It returns nil once it has moved nbytes or ctx is done, and
+	// otherwise an *Error that says why it failed.
+	Work(ctx context.Context, moved *atomic.Uint64, nbytes uint64, buf int, addr string) error
+	GetRPC() string
+}
+
+// payload dials the payload address addr of the server; the connection is
+// closed as soon as ctx is done, which ends any Read or Write on it.
+func payload(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fail("payload", err)
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, nil
+}
+
+// Type TCPSender implements TCPWorker interface for Upload speed test
+// It contains the name of the server side RPC function to call to initiate testing
+type TCPSender string
+
+func (s TCPSender) GetName() string {
+	return "UP"
+}
+
+func (s TCPSender) GetRPC() string {
+	return string(s)
+}
+
+// TCPSender Work method uploads nbyte bytes to tcp address addr until ctx is
+// done.
+func (s TCPSender) Work(ctx context.Context, moved *atomic.Uint64, nbytes uint64, buf int, addr string) error {
+	conn, err := payload(ctx, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer conn.Close()
+	if err = xfer.Send(conn, nbytes, buf, moved); err != nil && ctx.Err() == nil {
+		return fail("send", err)
+	}
+	return nil
+}
+
+// Type TCPReceiver implements TCPWorker interface for Download speed test
+// It contains the name of the server side RPC function to call to initiate testing
+type TCPReceiver string
+
+func (r TCPReceiver) GetName() string {
+	return "DOWN"
+}
+
+func (r TCPReceiver) GetRPC() string {
+	return string(r)
+}
+
+// TCPReceiver Work method downloads nbyte bytes from tcp address addr until
+// ctx is done.
+func (r TCPReceiver) Work(ctx context.Context, moved *atomic.Uint64, nbytes uint64, buf int, addr string) error {
+	conn, err := payload(ctx, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer conn.Close()
+	if err = xfer.Receive(conn, nbytes, buf, moved); err != nil && ctx.Err() == nil {
+		// io.ErrUnexpectedEOF if the server hung up early
+		return fail("receive", err)
+	}
+	return nil
+}
+
+// steady reports whether the last steadyN samples vary by less than
+// the relative standard deviation cv.
+func steady(s []stats.BitRate, cv float64) bool {
+	if len(s) < steadyN {
+		return false
+	}
+	s = s[len(s)-steadyN:]
+	var sum, sq float64
+	for _, x := range s {
+		sum += float64(x)
+	}
+	mean := sum / float64(len(s))
+	if mean == 0 {
+		return false
+	}
+	for _, x := range s {
+		d := float64(x) - mean
+		sq += d * d
+	}
+	return math.Sqrt(sq/float64(len(s)))/mean < cv
+}
+
+// spread returns the largest, smallest and standard deviation of the
+// interval rates in s.
+func spread(s []stats.BitRate) (max, min, sd stats.BitRate) {
+	if len(s) == 0 {
+		return
+	}
+	var sum, sq float64
+	min = s[0]
+	for _, x := range s {
+		if x > max {
+			max = x
+		}
+		if x < min {
+			min = x
+		}
+		sum += float64(x)
+	}
+	mean := sum / float64(len(s))
+	for _, x := range s {
+		d := float64(x) - mean
+		sq += d * d
+	}
+	sd = stats.BitRate(math.Sqrt(sq / float64(len(s))))
+	return
+}
+
+// skewed reports whether the sender and receiver side rates differ by
+// more than maxSkew of the receiver's rate.
+func skewed(send, recv stats.BitRate) bool {
+	if recv == 0 {
+		return send != 0
+	}
+	return math.Abs(float64(send)-float64(recv))/float64(recv) > maxSkew
+}
+
+// stream measures the throughput of an UP or DOWN transfer of cfg.Count
+// bytes, made by worker.
+func stream(ctx context.Context, opt Options, worker TCPWorker) (Result, error) {
+	name := worker.GetName()
+	cfg := opt.Config
+
+	opt.logln("Measuring ", name, " speed...")
+	client, err := dial(ctx, cfg)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, err
+	}
+	defer client.Close()
+
+	var (
+		moved   atomic.Uint64 // by the worker
+		seen    uint64        // of moved, by the sampler
+		rep     bool
+		addr    string
+		srv     stats.XferResult
+		br      stats.BitRate
+		stable  bool
+		stopped bool
+		early   bool // stopped once steady, before the whole count
+		aborted bool
+	)
+
+	err = client.Call("TCPPerf.TCPStart", 0, &addr)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, fail("TCPStart", err)
+	}
+
+	opt.logln("Payload address: ", addr)
+
+	rpcname := worker.GetRPC()
+	opt.logln("Calling ", rpcname, " ...")
+	aRcv := client.Go(rpcname, cfg.Count, &srv, nil)
+
+	// the worker counts what it moves until it returns; done is closed
+	// after that
+	wctx, stopwork := context.WithCancel(ctx)
+	defer stopwork()
+	var werr error
+	done := make(chan struct{})
+	go func() {
+		werr = worker.Work(wctx, &moved, cfg.Count, int(cfg.Buf), net.JoinHostPort(cfg.Host, addr))
+		close(done)
+	}()
+
+	opt.logln("Entering wait loop")
+	smp := newsampler(sysclock{}, cfg.Omit)
+	count := func() {
+		n := moved.Load()
+		smp.add(n - seen)
+		seen = n
+	}
+	stop := func() {
+		if !stopped {
+			stopped = true
+			stopwork()
+		}
+	}
+	timer := time.Tick(stats.Period)
+
+	// the worker keeps counting until it exits, even after we asked it
+	// to stop.
+L1:
+	for {
+		select {
+		case <-timer:
+			count()
+			smp.sample()
+			br = smp.rate()
+			if cfg.Steady > 0 && !stable && smp.steady(cfg.Steady) {
+				stable = true
+				opt.logln("Steady at ", br.Mbps(), " Mbps after ", smp.t1.Sub(smp.t0))
+				if cfg.Stop && !stopped {
+					early = true
+					stop()
+				}
+			}
+			// opt.logln("Bitrate: ", br.Mbps(), " Mbps")
+			if smp.total >= cfg.Count {
+				stop()
+			}
+			if stopped {
+				continue
+			}
+			opt.progress(Progress{Test: name, Rate: br, Steady: stable})
+		case <-ctx.Done():
+			if !aborted {
+				opt.logln("Aborting ", name)
+				aborted = true
+				stop()
+			}
+		case <-done:
+			count()
+			break L1
+		}
+	}
+	stop()
+
+	smp.sample()
+	br = smp.rate()
+	opt.progress(Progress{Test: name, Rate: br, Steady: stable})
+
+	if aborted || werr != nil {
+		// don't leave the server waiting for the payload
+		client.Call("TCPPerf.TCPStop", 0, &rep)
+	}
+	if aborted {
+		// the server may take a while to drain a slow link; closing
+		// the client ends its call
+		return Result{}, ctx.Err()
+	}
+	if werr != nil {
+		// a server that doesn't answer is left to time out on its own
+		// as the client is closed
+		select {
+		case <-aRcv.Done:
+		case <-ctx.Done():
+		case <-time.After(stopWait):
+		}
+		opt.logln(werr)
+		return Result{}, werr
+	}
+	select {
+	case <-aRcv.Done:
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+	if aRcv.Error != nil {
+		opt.logln(rpcname, aRcv.Error)
+		// the server sees a transfer cut short as failed, and net/rpc
+		// drops its account of it
+		if !early {
+			client.Call("TCPPerf.TCPStop", 0, &rep)
+			return Result{}, fail(rpcname, aRcv.Error)
+		}
+	}
+	sum, mine := smp.summary()
+	sum.Cfg = cfg
+	if worker.GetName() == "UP" {
+		sum.Send = mine
+	} else {
+		sum.Recv = mine
+	}
+	if aRcv.Error == nil {
+		sum.SrvBytes, sum.SrvElapsed, sum.SrvTimeline, sum.SrvCPU = srv.Bytes, srv.Elapsed, srv.Timeline, srv.CPU
+		// compare whole transfers as seen from each end
+		theirs := stats.Rate(srv.Bytes, srv.Elapsed)
+		if worker.GetName() == "UP" {
+			sum.Recv = theirs
+		} else {
+			sum.Send = theirs
+		}
+		sum.Skewed = skewed(sum.Send, sum.Recv)
+	}
+	opt.logln("My count: ", cfg.Count, " Server count: ", srv.Bytes, " Average: ", sum.Avg.Mbps(), "Mbps")
+	opt.logln("Sender: ", sum.Send.Mbps(), "Mbps Receiver: ", sum.Recv.Mbps(), "Mbps")
+	if sum.Skewed {
+		opt.logln("Sender and receiver rates differ by more than", maxSkew*100, "%; the path is buffering")
+	}
+
+	err = client.Call("TCPPerf.TCPStop", 0, &rep)
+	if err != nil {
+		opt.logln(err)
+	}
+	return Result{Test: name, Steady: stable, Summary: sum}, fail("TCPStop", err)
+}
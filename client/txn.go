@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// length of a transaction test when none is given
+const defDuration = 10 * time.Second
+
+// latency summarizes the durations in d; it sorts d in place.
+func latency(d []time.Duration) *stats.Latency {
+	if len(d) == 0 {
+		return &stats.Latency{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	var sum time.Duration
+	for _, x := range d {
+		sum += x
+	}
+	// nearest rank
+	pct := func(p float64) time.Duration {
+		i := int(math.Ceil(p*float64(len(d)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return d[i]
+	}
+	hist := make([]uint64, stats.Buckets)
+	for _, x := range d {
+		hist[stats.Bucket(x)]++
+	}
+	for len(hist) > 1 && hist[len(hist)-1] == 0 {
+		hist = hist[:len(hist)-1]
+	}
+	return &stats.Latency{
+		Hist: hist,
+		N:    len(d),
+		Min:  d[0],
+		Mean: sum / time.Duration(len(d)),
+		Max:  d[len(d)-1],
+		P50:  pct(0.5),
+		P90:  pct(0.9),
+		P99:  pct(0.99),
+		P999: pct(0.999),
+	}
+}
+
+// crr makes one connection to addr, exchanges buf with the server and waits
+// for the server to close, or for ctx to be done. It returns the time it
+// took to connect.
+func crr(ctx context.Context, addr string, buf []byte) (time.Duration, error) {
+	t := time.Now()
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, fail("payload", err)
+	}
+	hs := time.Since(t)
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(buf); err != nil {
+		return hs, fail("send", err)
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return hs, fail("receive", err)
+	}
+	if _, err = conn.Read(buf); err != io.EOF {
+		if err == nil {
+			err = errors.New("server did not close")
+		}
+		return hs, fail("receive", err)
+	}
+	return hs, nil
+}
+
+// txnloop calls txn back to back for the duration of opt, or until it fails
+// or ctx is done, reporting the transaction rate every half second. It
+// returns the latency of each transaction, the number of transactions in
+// each half second and the time it ran for.
+func txnloop(ctx context.Context, name string, opt Options, txn func() (time.Duration, error)) ([]time.Duration, []stats.Interval, time.Duration, error) {
+	var lat []time.Duration
+	var tl []stats.Interval
+	var err error
+
+	dur := opt.Dur
+	if dur == 0 {
+		dur = defDuration
+	}
+	t0 := time.Now()
+	t1 := t0
+	end := t0.Add(dur)
+	lcnt := 0
+	timer := time.Tick(stats.Period)
+
+L:
+	for time.Now().Before(end) {
+		select {
+		case <-ctx.Done():
+			opt.logln("Aborting ", name)
+			err = ctx.Err()
+			break L
+		default:
+		}
+		d, xerr := txn()
+		if xerr != nil {
+			opt.logln(xerr)
+			err = xerr
+			break
+		}
+		lat = append(lat, d)
+		lcnt++
+		select {
+		case <-timer:
+			tn := time.Now()
+			tps := float64(lcnt) / tn.Sub(t1).Seconds()
+			tl = append(tl, stats.Interval{At: tn.Sub(t0), Bytes: uint64(lcnt)})
+			t1, lcnt = tn, 0
+			opt.progress(Progress{Test: name, TPS: tps})
+		default:
+		}
+	}
+	elapsed := time.Since(t0)
+	if lcnt > 0 {
+		tl = append(tl, stats.Interval{At: elapsed, Bytes: uint64(lcnt)})
+	}
+	return lat, tl, elapsed, err
+}
+
+// crrtest measures connection setup in the style of netperf's TCP_CRR:
+// for opt.Dur it repeatedly connects to the server's payload port, exchanges
+// a one byte request and response and waits for the server to hang up. It
+// reports connections per second and the distribution of handshake times.
+func crrtest(ctx context.Context, opt Options) (Result, error) {
+	name := "CRR"
+	cfg := opt.Config
+
+	opt.logln("Measuring ", name, " rate...")
+	client, err := dial(ctx, cfg)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, err
+	}
+	defer client.Close()
+
+	var (
+		rep    bool
+		addr   string
+		served uint64
+	)
+
+	err = client.Call("TCPPerf.TCPStart", 0, &addr)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, fail("TCPStart", err)
+	}
+	opt.logln("Payload address: ", addr)
+
+	aCrr := client.Go("TCPPerf.TCPCrr", uint64(1), &served, nil)
+
+	buf := make([]byte, 1)
+	daddr := net.JoinHostPort(cfg.Host, addr)
+	hs, tl, elapsed, err := txnloop(ctx, name, opt, func() (time.Duration, error) {
+		return crr(ctx, daddr, buf)
+	})
+
+	// closing the payload listener ends TCPCrr
+	if xerr := client.Call("TCPPerf.TCPStop", 0, &rep); xerr != nil {
+		opt.logln(xerr)
+	}
+	if ctx.Err() != nil {
+		// the server may take a while to finish the connections under
+		// way; closing the client ends its call
+		return Result{}, ctx.Err()
+	}
+	<-aCrr.Done
+	if aCrr.Error != nil {
+		opt.logln("TCPPerf.TCPCrr", aCrr.Error)
+	}
+
+	sum := stats.Summary{Elapsed: elapsed, Txns: uint64(len(hs)), Timeline: tl, Cfg: cfg}
+	sum.TPS = float64(sum.Txns) / elapsed.Seconds()
+	sum.Lat = latency(hs)
+	opt.logln("Connections: ", sum.Txns, " Server count: ", served, " Rate: ", sum.TPS, "conn/s",
+		" Handshake p50: ", sum.Lat.P50, " p99: ", sum.Lat.P99)
+	return Result{Test: name, Summary: sum}, err
+}
+
+// rr sends req on conn and reads back a response filling resp. It returns
+// the round trip time.
+func rr(conn net.Conn, req, resp []byte) (time.Duration, error) {
+	t := time.Now()
+	conn.SetDeadline(t.Add(5 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		return 0, fail("send", err)
+	}
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return 0, fail("receive", err)
+	}
+	return time.Since(t), nil
+}
+
+// rrtest measures transaction latency in the style of netperf's TCP_RR:
+// for opt.Dur it exchanges requests of opt.Req bytes and responses of opt.Resp
+// bytes with the server, one at a time on a single connection, and reports
+// transactions per second and latency percentiles.
+func rrtest(ctx context.Context, opt Options) (Result, error) {
+	name := "RR"
+	cfg := opt.Config
+	if cfg.Req > stats.MaxTxn || cfg.Resp > stats.MaxTxn {
+		return Result{}, fmt.Errorf("%w: request %d and response %d bytes, at most %d", ErrTxnSize, cfg.Req, cfg.Resp, stats.MaxTxn)
+	}
+
+	opt.logln("Measuring ", name, " rate...")
+	client, err := dial(ctx, cfg)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, err
+	}
+	defer client.Close()
+
+	var (
+		rep    bool
+		addr   string
+		served uint64
+	)
+
+	err = client.Call("TCPPerf.TCPStart", 0, &addr)
+	if err != nil {
+		opt.logln(err)
+		return Result{}, fail("TCPStart", err)
+	}
+	opt.logln("Payload address: ", addr)
+
+	sz := stats.TxnSize{Req: cfg.Req, Resp: cfg.Resp}
+	if sz.Req == 0 {
+		sz.Req = 1
+	}
+	if sz.Resp == 0 {
+		sz.Resp = 1
+	}
+	aRR := client.Go("TCPPerf.TCPRR", sz, &served, nil)
+
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, "tcp", net.JoinHostPort(cfg.Host, addr))
+	if err != nil {
+		opt.logln(err)
+		client.Call("TCPPerf.TCPStop", 0, &rep)
+		return Result{}, fail("payload", err)
+	}
+	// an abort ends the transaction under way
+	context.AfterFunc(ctx, func() { conn.Close() })
+	req := make([]byte, sz.Req)
+	resp := make([]byte, sz.Resp)
+	lat, tl, elapsed, err := txnloop(ctx, name, opt, func() (time.Duration, error) {
+		return rr(conn, req, resp)
+	})
+	conn.Close() // ends TCPRR, once the server sees it
+
+	if ctx.Err() != nil {
+		client.Call("TCPPerf.TCPStop", 0, &rep)
+		return Result{}, ctx.Err()
+	}
+	<-aRR.Done
+	if aRR.Error != nil {
+		opt.logln("TCPPerf.TCPRR", aRR.Error)
+	}
+	if xerr := client.Call("TCPPerf.TCPStop", 0, &rep); xerr != nil {
+		opt.logln(xerr)
+	}
+
+	sum := stats.Summary{Elapsed: elapsed, Txns: uint64(len(lat)), Timeline: tl, Cfg: cfg}
+	sum.TPS = float64(sum.Txns) / elapsed.Seconds()
+	sum.Lat = latency(lat)
+	opt.logln("Transactions: ", sum.Txns, " Server count: ", served, " Rate: ", sum.TPS, "/s",
+		" p50: ", sum.Lat.P50, " p99: ", sum.Lat.P99, " p99.9: ", sum.Lat.P999)
+	return Result{Test: name, Summary: sum}, err
+}
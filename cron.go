@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five field cron expression: minute, hour, day of month,
+// month and day of week. Each field is "*", a number, a range "a-b", any of
+// those followed by a step "/n", or a comma separated list of them.
+type Cron struct {
+	min, hour, dom, mon, dow uint64 // bit sets of allowed values
+	anydom, anydow           bool   // day of month or week was "*"
+}
+
+// ranges of the five fields
+var cronlim = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// ParseCron parses a cron expression such as "*/15 6-22 * * 1-5".
+func ParseCron(s string) (*Cron, error) {
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, errors.New("cron: need five fields: " + s)
+	}
+	var sets [5]uint64
+	for i, x := range f {
+		b, err := cronfield(x, cronlim[i][0], cronlim[i][1])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = b
+	}
+	// Sunday may also be written as 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &Cron{sets[0], sets[1], sets[2], sets[3], sets[4], f[2] == "*", f[4] == "*"}, nil
+}
+
+// cronfield parses one field whose values lie between lo and hi.
+func cronfield(s string, lo, hi int) (uint64, error) {
+	var set uint64
+	if hi == 6 {
+		hi = 7 // day of week
+	}
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.New("cron: bad step: " + part)
+			}
+			step = n
+			part = part[:i]
+		}
+		a, b := lo, hi
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if a, err = strconv.Atoi(r[0]); err != nil {
+				return 0, errors.New("cron: bad value: " + part)
+			}
+			b = a
+			if len(r) == 2 {
+				if b, err = strconv.Atoi(r[1]); err != nil {
+					return 0, errors.New("cron: bad range: " + part)
+				}
+			} else if step > 1 {
+				b = hi
+			}
+		}
+		if a < lo || b > hi || a > b {
+			return 0, errors.New("cron: out of range: " + part)
+		}
+		for v := a; v <= b; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
+
+// day reports whether the date of t is allowed; as in cron(8), when both
+// day of month and day of week are restricted, either may match.
+func (c *Cron) day(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	switch {
+	case c.anydom:
+		return dow
+	case c.anydow:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that matches c, or the zero time if
+// there is none within five years.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case !has(c.mon, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(c.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(c.min, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
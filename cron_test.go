@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, s := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"1-x * * * *",
+	} {
+		if _, err := ParseCron(s); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2025, 1, 1, 10, 7, 30, 0, time.UTC)
+	for _, c := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2025, 1, 1, 10, 25, 0, 0, time.UTC)},
+		{"0 6-8,22 * * *", time.Date(2025, 1, 1, 22, 0, 0, 0, time.UTC)},
+		{"0-10/5 11 * * *", time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * 1-5", time.Date(2025, 1, 2, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2,4 *", time.Time{}}, // never
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 9 1 * *", time.Date(2025, 2, 1, 9, 0, 0, 0, time.UTC)},
+		// either day rule matches when both are restricted
+		{"0 12 15 * 5", time.Date(2025, 1, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 2 * 5", time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)},
+		// but only the restricted one when the other is "*"
+		{"0 12 * * 5", time.Date(2025, 1, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 15 * *", time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)},
+	} {
+		cr, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", c.expr, err)
+			continue
+		}
+		if got := cr.Next(from); !got.Equal(c.want) {
+			t.Errorf("%q: next after %v is %v, want %v", c.expr, from, got, c.want)
+		}
+	}
+}
+
+func TestCronNextExact(t *testing.T) {
+	cr, err := ParseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a matching time is not its own next
+	at := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	if got, want := cr.Next(at), at.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("next after %v is %v, want %v", at, got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// how many Stats a viewer may fall behind before it is dropped
+const hubBacklog = 256
+
+// Hub fans Stats out to their subscribers, so that every viewer of a test
+// sees the same complete stream. A subscriber too slow to keep up is
+// unsubscribed, and its channel closed, rather than hold up the others.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan Stats]func(*Stats) bool
+}
+
+// NewHub returns a Hub without subscribers.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan Stats]func(*Stats) bool)}
+}
+
+// Subscribe returns a channel that receives the Stats published from now
+// on that want accepts, or all of them if want is nil.
+func (h *Hub) Subscribe(want func(*Stats) bool) chan Stats {
+	if want == nil {
+		want = func(*Stats) bool { return true }
+	}
+	ch := make(chan Stats, hubBacklog)
+	h.mu.Lock()
+	h.subs[ch] = want
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops delivery to ch and closes it.
+func (h *Hub) Unsubscribe(ch chan Stats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish sends st to the subscribers that want it.
+func (h *Hub) Publish(st Stats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, want := range h.subs {
+		if !want(&st) {
+			continue
+		}
+		select {
+		case ch <- st:
+		default:
+			log.Println("events: dropping a slow viewer")
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func jsonstats(st *Stats) JSONStats {
+	jst := JSONStats{ID: st.ID, Stat: st.Stat, Type: st.Type, Rate: st.Rate.Mbps(), Steady: st.Steady, TPS: st.TPS,
+		Reason: st.Reason, Err: st.Err, Regr: st.Regr}
+	if st.Sum != nil {
+		jst.Sum = jsonsummary(st.Sum)
+	}
+	return jst
+}
+
+// name of the cookie that tells browser sessions apart
+const sessionCookie = "tcpmeter-session"
+
+// sessionid returns the id of the browser session of r, or "" if it has none.
+func sessionid(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// startsession gives the browser a session id, unless it has one.
+func startsession(w http.ResponseWriter, r *http.Request) {
+	if sessionid(r) != "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: newid(), Path: "/", HttpOnly: true,
+		SameSite: http.SameSiteStrictMode})
+}
+
+// viewer returns what a request for stats wants to see: the test named
+// by its test parameter, every test if all is set, and otherwise the
+// tests started from its own browser session.
+func viewer(r *http.Request, ts *Tests) func(*Stats) bool {
+	if id := r.FormValue("test"); id != "" {
+		return func(st *Stats) bool { return st.ID == id }
+	}
+	if r.FormValue("all") != "" {
+		return nil
+	}
+	s := sessionid(r)
+	return func(st *Stats) bool { return st.ID != "" && s != "" && ts.Session(st.ID) == s }
+}
+
+// CEventHandler streams TCPClient stats to a browser as server-sent
+// events at /events, one JSONStats per event, until the viewer goes away.
+// Which tests it follows is up to viewer.
+type CEventHandler struct {
+	Hub *Hub
+	T   *Tests
+}
+
+func (e *CEventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := e.Hub.Subscribe(viewer(r, e.T))
+	defer e.Hub.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+	for {
+		select {
+		case st, ok := <-ch:
+			if !ok {
+				return // fell behind; the browser reconnects
+			}
+			b, err := json.Marshal(jsonstats(&st))
+			if err != nil {
+				log.Println("events: ", err)
+				continue
+			}
+			if _, err = w.Write([]byte("data: " + string(b) + "\n\n")); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// Sample is one period of a run's timeline, as exported.
+type Sample struct {
+	Time    time.Time // when the period ended
+	Elapsed float64   // seconds from the start of the run
+	Side    string    // "client" or "server"
+	Count   uint64    // bytes, or transactions for CRR and RR
+	Rate    float64   // Mbps, or transactions per second
+}
+
+// span is how long a run took from its start to its last sample.
+func span(r *Result) time.Duration {
+	d := r.Sum.Elapsed
+	for _, tl := range [][]stats.Interval{r.Sum.Timeline, r.Sum.SrvTimeline} {
+		if n := len(tl); n > 0 && tl[n-1].At > d {
+			d = tl[n-1].At
+		}
+	}
+	return d
+}
+
+// samples returns the client and then the server timeline of r. The
+// history keeps when a run finished, so times are reckoned back from then.
+func samples(r *Result) []Sample {
+	start := r.Time.Add(-span(r))
+	txn := r.Sum.Lat != nil
+	var ss []Sample
+	for _, side := range []struct {
+		name string
+		tl   []stats.Interval
+	}{{"client", r.Sum.Timeline}, {"server", r.Sum.SrvTimeline}} {
+		var prev time.Duration
+		for _, x := range side.tl {
+			d := (x.At - prev).Seconds()
+			prev = x.At
+			if d <= 0 {
+				continue
+			}
+			rate := float64(x.Bytes) / d
+			if !txn {
+				rate = rate * 8 / 1e6
+			}
+			ss = append(ss, Sample{start.Add(x.At), x.At.Seconds(), side.name, x.Bytes, rate})
+		}
+	}
+	return ss
+}
+
+// JSONExport is everything known about a run, for download.
+type JSONExport struct {
+	JSONResult
+	Start   time.Time
+	Units   map[string]string
+	Samples []Sample
+}
+
+func units(txn bool) map[string]string {
+	u := map[string]string{
+		"Size": "bytes", "Dur": "s", "Omit": "s", "Req": "bytes", "Resp": "bytes",
+		"Sum.Bytes": "bytes", "Sum.SrvBytes": "bytes", "Sum.Elapsed": "s", "Sum.SrvElapsed": "s",
+		"Sum.Avg": "Mbps", "Sum.Peak": "Mbps", "Sum.Min": "Mbps", "Sum.StdDev": "Mbps",
+		"Sum.Send": "Mbps", "Sum.Recv": "Mbps", "Sum.TPS": "1/s", "Sum.Lat": "ms",
+		"Samples.Elapsed": "s", "Samples.Count": "bytes", "Samples.Rate": "Mbps",
+	}
+	if txn {
+		u["Samples.Count"], u["Samples.Rate"] = "transactions", "1/s"
+	}
+	return u
+}
+
+func exportjson(w http.ResponseWriter, r *Result) {
+	x := JSONExport{
+		JSONResult: jsonresult(r, false),
+		Start:      r.Time.Add(-span(r)),
+		Units:      units(r.Sum.Lat != nil),
+		Samples:    samples(r),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	attach(w, r, "json")
+	je := json.NewEncoder(w)
+	je.SetIndent("", "\t")
+	je.Encode(x)
+}
+
+func samplescsv(w http.ResponseWriter, r *Result) {
+	w.Header().Set("Content-Type", "text/csv")
+	attach(w, r, "csv")
+	cw := csv.NewWriter(w)
+	if r.Sum.Lat != nil {
+		cw.Write([]string{"time", "elapsed_s", "side", "transactions", "rate_per_s"})
+	} else {
+		cw.Write([]string{"time", "elapsed_s", "side", "bytes", "rate_mbps"})
+	}
+	for _, s := range samples(r) {
+		cw.Write([]string{s.Time.Format(time.RFC3339Nano), ftoa(s.Elapsed), s.Side,
+			strconv.FormatUint(s.Count, 10), ftoa(s.Rate)})
+	}
+	cw.Flush()
+}
+
+func summarycsv(w http.ResponseWriter, r *Result) {
+	w.Header().Set("Content-Type", "text/csv")
+	attach(w, r, "summary.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"field", "value", "unit"})
+	cw.WriteAll(summary(r))
+}
+
+// summary lists the parameters and results of r as field, value and unit.
+func summary(r *Result) [][]string {
+	c, sm := &r.Sum.Cfg, &r.Sum
+	var rows [][]string
+	row := func(k, v, u string) { rows = append(rows, []string{k, v, u}) }
+	u64 := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	row("id", r.ID, "")
+	row("test", r.Test, "")
+	row("host", c.Host, "")
+	row("port", c.RPCPort, "")
+	row("start", r.Time.Add(-span(r)).Format(time.RFC3339Nano), "")
+	row("end", r.Time.Format(time.RFC3339Nano), "")
+	row("elapsed", ftoa(sm.Elapsed.Seconds()), "s")
+	if l := sm.Lat; l != nil {
+		row("duration", ftoa(c.Dur.Seconds()), "s")
+		if r.Test == "RR" {
+			row("request", u64(max(c.Req, 1)), "bytes") // as the client defaults them
+			row("response", u64(max(c.Resp, 1)), "bytes")
+		}
+		row("transactions", u64(sm.Txns), "")
+		row("rate", ftoa(sm.TPS), "1/s")
+		for _, x := range []struct {
+			k string
+			d time.Duration
+		}{{"latency_min", l.Min}, {"latency_mean", l.Mean}, {"latency_p50", l.P50}, {"latency_p90", l.P90},
+			{"latency_p99", l.P99}, {"latency_p999", l.P999}, {"latency_max", l.Max}} {
+			row(x.k, ftoa(ms(x.d)), "ms")
+		}
+	} else {
+		row("size", u64(c.Count), "bytes")
+		row("omit", ftoa(c.Omit.Seconds()), "s")
+		row("bytes", u64(sm.Bytes), "bytes")
+		row("server_bytes", u64(sm.SrvBytes), "bytes")
+		row("server_elapsed", ftoa(sm.SrvElapsed.Seconds()), "s")
+		for _, x := range []struct {
+			k string
+			b stats.BitRate
+		}{{"average", sm.Avg}, {"peak", sm.Peak}, {"min", sm.Min}, {"stddev", sm.StdDev},
+			{"sender", sm.Send}, {"receiver", sm.Recv}} {
+			row(x.k, ftoa(float64(x.b)/1e6), "Mbps")
+		}
+		row("skewed", strconv.FormatBool(sm.Skewed), "")
+	}
+	if rg := r.Regr; rg != nil {
+		if sm.Lat != nil {
+			row("baseline", ftoa(rg.Ref), "1/s")
+		} else {
+			row("baseline", ftoa(rg.Ref/1e6), "Mbps")
+		}
+		row("baseline_drop", ftoa(rg.Drop*100), "%")
+		row("baseline_tolerance", ftoa(rg.Tol*100), "%")
+	}
+	return rows
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// attach names the download after the run.
+func attach(w http.ResponseWriter, r *Result, ext string) {
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="tcpmeter-%s-%s-%s.%s"`, r.Sum.Cfg.Host, r.Test, r.ID, ext))
+}
+
+// exports are the downloads of a run, by the name that follows its id
+// in /history/{id}/...
+var exports = map[string]func(http.ResponseWriter, *Result){
+	"export.json": exportjson,
+	"samples.csv": samplescsv,
+	"summary.csv": summarycsv,
+}
@@ -0,0 +1,3 @@
+module github.com/9nut/tcpmeter
+
+go 1.22
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// Result is a completed test as kept in the history.
+type Result struct {
+	ID   string
+	Time time.Time // when the test finished
+	Test string
+	Sum  stats.Summary
+	Regr *Regression `json:",omitempty"` // how it fell short of its baseline
+}
+
+// History is an append-only store of results, kept as one JSON object per
+// line so that a crash loses at most the line being written.
+type History struct {
+	mu   sync.Mutex
+	path string
+	seq  int
+}
+
+// history receives every completed test; see LogClient.
+var history *History
+
+// OpenHistory opens, creating if needed, the history file at path.
+func OpenHistory(path string) (*History, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	h := &History{path: path}
+	rs, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	// carry on the sequence of the IDs given before, so that none is
+	// given twice in the same second
+	for _, r := range rs {
+		if _, n, ok := strings.Cut(r.ID, "-"); ok {
+			if seq, err := strconv.Atoi(n); err == nil && seq > h.seq {
+				h.seq = seq
+			}
+		}
+	}
+	return h, nil
+}
+
+// Add appends the result of a completed test, giving it an ID and time.
+func (h *History) Add(r Result) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.seq++
+	r.ID = fmt.Sprintf("%d-%d", now.Unix(), h.seq)
+	r.Time = now
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(r)
+}
+
+// Load returns every result in the order they were added. Lines that
+// don't parse, such as one cut short by a crash, are skipped.
+func (h *History) Load() ([]Result, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rs []Result
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var r Result
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			log.Println("history: ", err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, sc.Err()
+}
+
+// Get returns the result with the given id.
+func (h *History) Get(id string) (Result, bool, error) {
+	rs, err := h.Load()
+	if err != nil {
+		return Result{}, false, err
+	}
+	for _, r := range rs {
+		if r.ID == id {
+			return r, true, nil
+		}
+	}
+	return Result{}, false, nil
+}
+
+// Filter selects results; empty fields match everything.
+type Filter struct {
+	Host string
+	Test string
+	From time.Time
+	To   time.Time // exclusive
+}
+
+func (f *Filter) match(r *Result) bool {
+	switch {
+	case f.Host != "" && f.Host != r.Sum.Cfg.Host:
+		return false
+	case f.Test != "" && f.Test != r.Test:
+		return false
+	case !f.From.IsZero() && r.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && !r.Time.Before(f.To):
+		return false
+	}
+	return true
+}
+
+// Find returns the results that f selects, oldest first.
+func (h *History) Find(f Filter) ([]Result, error) {
+	rs, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	sel := rs[:0]
+	for i := range rs {
+		if f.match(&rs[i]) {
+			sel = append(sel, rs[i])
+		}
+	}
+	return sel, nil
+}
+
+// parsewhen parses a filter date: either RFC 3339 or a day, as in
+// 2006-01-02. A day given as the end of a range includes all of it.
+func parsewhen(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// JSONPoint is one period of a timeline: when it ended, in seconds from the
+// start of the test, and the rate over it, in Mbps or transactions per second.
+type JSONPoint struct {
+	At   float64
+	Rate float64
+}
+
+func jsontimeline(tl []stats.Interval, txn bool) []JSONPoint {
+	ps := make([]JSONPoint, 0, len(tl))
+	var prev time.Duration
+	for _, x := range tl {
+		d := (x.At - prev).Seconds()
+		prev = x.At
+		if d <= 0 {
+			continue
+		}
+		r := float64(x.Bytes) / d
+		if !txn {
+			r = r * 8 / 1e6
+		}
+		ps = append(ps, JSONPoint{x.At.Seconds(), r})
+	}
+	return ps
+}
+
+// JSONResult is a Result with the summary in the units of JSONSummary. The
+// timelines are only filled in when a single result is asked for.
+type JSONResult struct {
+	ID          string
+	Time        time.Time
+	Test        string
+	Host        string
+	Port        string
+	Size        uint64  // bytes, for UP and DOWN tests
+	Dur         float64 // seconds, for CRR and RR tests
+	Omit        float64 // seconds
+	Req         uint64
+	Resp        uint64
+	Sum         *JSONSummary
+	Regr        *Regression `json:",omitempty"`
+	Timeline    []JSONPoint `json:",omitempty"`
+	SrvTimeline []JSONPoint `json:",omitempty"`
+}
+
+func jsonresult(r *Result, full bool) JSONResult {
+	c := &r.Sum.Cfg
+	jr := JSONResult{
+		ID:   r.ID,
+		Time: r.Time,
+		Test: r.Test,
+		Host: c.Host,
+		Port: c.RPCPort,
+		Size: c.Count,
+		Dur:  c.Dur.Seconds(),
+		Omit: c.Omit.Seconds(),
+		Req:  c.Req,
+		Resp: c.Resp,
+		Sum:  jsonsummary(&r.Sum),
+		Regr: r.Regr,
+	}
+	if full {
+		txn := r.Sum.Lat != nil
+		jr.Timeline = jsontimeline(r.Sum.Timeline, txn)
+		jr.SrvTimeline = jsontimeline(r.Sum.SrvTimeline, txn)
+	}
+	return jr
+}
+
+// HistHandler serves the history in JSON: /history lists the results that
+// match the optional host, test, from and to query parameters, and
+// /history/{id} returns one result along with its timelines. A run can
+// also be downloaded from /history/{id}/samples.csv, summary.csv and
+// export.json.
+type HistHandler struct {
+	H *History
+}
+
+func (hh *HistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	if id := strings.TrimPrefix(r.URL.Path, "/history/"); id != r.URL.Path && id != "" {
+		id, file, _ := strings.Cut(id, "/")
+		export, ok := exports[file]
+		if file != "" && !ok {
+			http.NotFound(w, r)
+			return
+		}
+		res, ok, err := hh.H.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if export != nil {
+			export(w, &res)
+			return
+		}
+		v = jsonresult(&res, true)
+	} else {
+		var f Filter
+		var err1, err2 error
+		f.Host = r.FormValue("host")
+		f.Test = r.FormValue("test")
+		f.From, err1 = parsewhen(r.FormValue("from"), false)
+		f.To, err2 = parsewhen(r.FormValue("to"), true)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "bad date; use 2006-01-02 or RFC 3339", http.StatusBadRequest)
+			return
+		}
+		rs, err := hh.H.Find(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		js := make([]JSONResult, 0, len(rs))
+		for i := range rs {
+			js = append(js, jsonresult(&rs[i], false))
+		}
+		v = js
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
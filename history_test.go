@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	ids := make(map[string]bool)
+	// reopened as after a restart, within the same second
+	for i := 0; i < 3; i++ {
+		h, err := OpenHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			if err := h.Add(Result{Test: "UP"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rs, err := h.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rs[len(rs)-2:] {
+			if ids[r.ID] {
+				t.Errorf("ID %s given twice", r.ID)
+			}
+			ids[r.ID] = true
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Package impair makes a network connection behave like a poorer link: it
+// caps its bandwidth, delays its data, stalls it as a lost segment would
+// and resets it, so that tcpmeter can be tested without a bad network.
+package impair
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	chunk    = 16 << 10 // most bytes the link moves at once
+	window   = 4 << 20  // most bytes in flight each way
+	defStall = 200 * time.Millisecond
+	linger   = 10 * time.Second // longest Close keeps sending what was written
+)
+
+// ErrReset is returned by a connection once its Profile has reset it.
+var ErrReset = fmt.Errorf("impair: %w", syscall.ECONNRESET)
+
+// Profile describes one direction of an impaired link.
+type Profile struct {
+	Rate   uint64        // bytes per second; 0 is unlimited
+	Delay  time.Duration // added to the time every byte takes
+	Jitter time.Duration // up to this much more delay, at random; the order is kept
+	Loss   float64       // chance, for every chunk, that the link stalls as if it was lost
+	Stall  time.Duration // how long a loss stalls the link; 200ms if 0
+	Reset  uint64        // bytes after which the connection is reset; 0 for never
+}
+
+// link schedules the data going one way through a Profile.
+type link struct {
+	p     atomic.Pointer[Profile]
+	free  time.Time // when the link has sent what it was given
+	last  time.Time // latest arrival, which later data may not overtake
+	moved uint64
+	cut   bool // moved reached Reset
+}
+
+// take returns how many of n bytes the link moves next: no more than a
+// chunk, and none past Reset.
+func (l *link) take(n int) int {
+	n = min(n, chunk)
+	if p := l.p.Load(); p.Reset > 0 {
+		n = int(min(uint64(n), p.Reset-min(l.moved, p.Reset)))
+	}
+	return n
+}
+
+// send schedules n bytes given to the link at now. It returns when they
+// reach the far end, and whether the connection is to be reset after them.
+func (l *link) send(now time.Time, n int) (time.Time, bool) {
+	p := l.p.Load()
+	t := now
+	if l.free.After(t) {
+		t = l.free
+	}
+	if p.Rate > 0 {
+		t = t.Add(time.Duration(float64(n) * float64(time.Second) / float64(p.Rate)))
+	}
+	if p.Loss > 0 && rand.Float64() < p.Loss {
+		stall := p.Stall
+		if stall == 0 {
+			stall = defStall
+		}
+		t = t.Add(stall)
+	}
+	l.free = t
+	at := t.Add(p.Delay)
+	if p.Jitter > 0 {
+		at = at.Add(rand.N(p.Jitter))
+	}
+	if at.Before(l.last) {
+		at = l.last
+	}
+	l.last = at
+	l.moved += uint64(n)
+	l.cut = p.Reset > 0 && l.moved >= p.Reset
+	return at, l.cut
+}
+
+// piece is some data on its way, due at.
+type piece struct {
+	b     []byte
+	at    time.Time
+	reset bool // the connection is reset after it
+}
+
+type conn struct {
+	net.Conn
+	in, out link
+
+	rmu  sync.Mutex
+	rq   chan piece // what came from the peer, in order
+	rest piece      // of what Read is part way through
+	rerr error      // why rq was closed
+
+	wmu   sync.Mutex    // keeps the pieces of concurrent Writes together
+	wq    chan piece    // what is to go to the peer
+	wshut bool          // wq is closed
+	sent  chan struct{} // closed once wq is drained, or sending failed
+
+	emu sync.Mutex
+	err error // that ended the connection
+
+	rdl, wdl atomic.Int64 // deadlines in unix nanoseconds; 0 for none
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Impaired is a connection returned by Conn.
+type Impaired interface {
+	net.Conn
+	// SetProfile changes the Profiles of the connection, for the data
+	// that it is given from then on.
+	SetProfile(in, out Profile)
+	// CloseWrite shuts down the writing side of the connection once what
+	// was written to it has been sent, however long that takes.
+	CloseWrite() error
+}
+
+// Conn returns c impaired by in, for what is read from it, and by out, for
+// what is written to it. A deadline set on the returned Conn applies to the
+// Reads and Writes that start after it was set.
+func Conn(c net.Conn, in, out Profile) Impaired {
+	ic := &conn{Conn: c,
+		rq: make(chan piece, window/chunk), wq: make(chan piece, window/chunk),
+		sent: make(chan struct{}), done: make(chan struct{})}
+	ic.SetProfile(in, out)
+	go ic.receive()
+	go ic.send()
+	return ic
+}
+
+// receive reads what the peer sends and queues it for Read.
+func (c *conn) receive() {
+	defer close(c.rq)
+	for {
+		k := c.in.take(chunk)
+		if k == 0 {
+			// Reset was lowered below what has come through
+			c.fail(ErrReset)
+			c.reset()
+			c.rerr = ErrReset
+			return
+		}
+		b := make([]byte, k)
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			at, reset := c.in.send(time.Now(), n)
+			select {
+			case c.rq <- piece{b: b[:n], at: at}:
+			case <-c.done:
+				return
+			}
+			if reset {
+				c.fail(ErrReset)
+				c.reset()
+				c.rerr = ErrReset
+				return
+			}
+		}
+		if err != nil {
+			if ferr := c.failed(); ferr != nil {
+				err = ferr
+			}
+			c.rerr = err
+			return
+		}
+	}
+}
+
+// send writes the pieces queued by Write to the peer, each when it is due.
+func (c *conn) send() {
+	defer close(c.sent)
+	for p := range c.wq {
+		if d := time.Until(p.at); d > 0 {
+			time.Sleep(d)
+		}
+		if _, err := c.Conn.Write(p.b); err != nil {
+			c.fail(err)
+			return
+		}
+		if p.reset {
+			c.fail(ErrReset)
+			c.reset()
+			return
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	dl, stop, err := timeout(&c.rdl)
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+	if len(c.rest.b) == 0 {
+		select {
+		case p, ok := <-c.rq:
+			if !ok {
+				if c.rerr == nil {
+					return 0, net.ErrClosed
+				}
+				return 0, c.rerr
+			}
+			c.rest = p
+		case <-dl:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+	if d := time.Until(c.rest.at); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-dl:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.rest.b)
+	c.rest.b = c.rest.b[n:]
+	return n, nil
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wshut {
+		return 0, net.ErrClosed
+	}
+	dl, stop, err := timeout(&c.wdl)
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+	n := 0
+	for n < len(b) {
+		if err := c.failed(); err != nil {
+			return n, err
+		}
+		k := c.out.take(len(b) - n)
+		if k == 0 {
+			if !c.out.cut {
+				// Reset was lowered below what has gone through
+				c.fail(ErrReset)
+				c.reset()
+			}
+			return n, ErrReset
+		}
+		at, reset := c.out.send(time.Now(), k)
+		p := piece{b: append([]byte(nil), b[n:n+k]...), at: at, reset: reset}
+		select {
+		case c.wq <- p:
+		case <-dl:
+			return n, os.ErrDeadlineExceeded
+		case <-c.done:
+			return n, net.ErrClosed
+		case <-c.sent:
+			if err := c.failed(); err != nil {
+				return n, err
+			}
+			return n, net.ErrClosed
+		}
+		n += k
+	}
+	return n, nil
+}
+
+// Close closes the connection once what was written to it has been sent,
+// as the kernel would, but without waiting for that.
+func (c *conn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		err = nil
+		close(c.done)
+		go func() {
+			c.shut()
+			select {
+			case <-c.sent:
+			case <-time.After(linger):
+			}
+			c.Conn.Close()
+		}()
+	})
+	return err
+}
+
+func (c *conn) CloseWrite() error {
+	c.shut()
+	go func() {
+		<-c.sent
+		if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok && c.failed() == nil {
+			cw.CloseWrite()
+		}
+	}()
+	return nil
+}
+
+// shut closes wq, so that send ends once it has sent what it holds.
+func (c *conn) shut() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.wshut {
+		c.wshut = true
+		close(c.wq)
+	}
+}
+
+func (c *conn) SetProfile(in, out Profile) {
+	c.in.p.Store(&in)
+	c.out.p.Store(&out)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.rdl.Store(unixnano(t))
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.wdl.Store(unixnano(t))
+	return nil
+}
+
+func unixnano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// timeout returns a channel that fires at the deadline in dl, if there is
+// one, and a function to stop it; it fails if the deadline has passed.
+func timeout(dl *atomic.Int64) (<-chan time.Time, func(), error) {
+	ns := dl.Load()
+	if ns == 0 {
+		return nil, func() {}, nil
+	}
+	d := time.Until(time.Unix(0, ns))
+	if d <= 0 {
+		return nil, nil, os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }, nil
+}
+
+func (c *conn) fail(err error) {
+	c.emu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.emu.Unlock()
+}
+
+func (c *conn) failed() error {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	return c.err
+}
+
+// reset aborts the connection, so that the peer sees a reset.
+func (c *conn) reset() {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Conn.Close()
+}
+
+// Listen returns l with every connection it accepts impaired by in and out;
+// see Conn.
+func Listen(l net.Listener, in, out Profile) net.Listener {
+	return &listener{Listener: l, in: in, out: out}
+}
+
+type listener struct {
+	net.Listener
+	in, out Profile
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Conn(c, l.in, l.out), nil
+}
+
+// SetDeadline sets the deadline of Accept, if the listener has one.
+func (l *listener) SetDeadline(t time.Time) error {
+	if dl, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return dl.SetDeadline(t)
+	}
+	return errors.New("impair: listener has no deadline")
+}
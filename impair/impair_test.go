@@ -0,0 +1,218 @@
+package impair
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pair returns the two ends of a loopback connection, the first impaired
+// by in and out.
+func pair(t *testing.T, in, out Profile) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l = Listen(l, in, out)
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return c, peer
+}
+
+// atleast fails t if got is less than want, which the impairment imposes,
+// or so much more that the impairment can't be as set; the room above is
+// for busy machines.
+func atleast(t *testing.T, what string, got, want time.Duration) {
+	t.Helper()
+	if got < want || got > 2*want+250*time.Millisecond {
+		t.Errorf("%s took %v, want at least %v and not much more", what, got, want)
+	}
+}
+
+func TestRateOut(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Rate: 4 << 20})
+	buf := make([]byte, 2<<20)
+	t0 := time.Now()
+	go c.Write(make([]byte, len(buf)))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "2MiB at 4MiB/s", time.Since(t0), 500*time.Millisecond)
+}
+
+func TestRateIn(t *testing.T) {
+	c, peer := pair(t, Profile{Rate: 4 << 20}, Profile{})
+	buf := make([]byte, 2<<20)
+	t0 := time.Now()
+	go peer.Write(make([]byte, len(buf)))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "2MiB at 4MiB/s", time.Since(t0), 500*time.Millisecond)
+}
+
+func TestDelay(t *testing.T) {
+	c, peer := pair(t, Profile{Delay: 30 * time.Millisecond}, Profile{Delay: 50 * time.Millisecond})
+	b := []byte{1}
+	t0 := time.Now()
+	c.Write(b)
+	if _, err := peer.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "write", time.Since(t0), 50*time.Millisecond)
+
+	t0 = time.Now()
+	peer.Write(b)
+	if _, err := c.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "read", time.Since(t0), 30*time.Millisecond)
+}
+
+func TestJitterKeepsOrder(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Delay: 5 * time.Millisecond, Jitter: 20 * time.Millisecond})
+	want := make([]byte, 200)
+	for i := range want {
+		want[i] = byte(i)
+		c.Write(want[i : i+1])
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLossStalls(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Loss: 1, Stall: 100 * time.Millisecond})
+	b := []byte{1}
+	t0 := time.Now()
+	c.Write(b)
+	if _, err := peer.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "lost write", time.Since(t0), 100*time.Millisecond)
+}
+
+func TestReset(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Reset: 1000})
+	n, err := c.Write(make([]byte, 4000))
+	if n != 1000 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Write = %d, %v; want 1000, %v", n, err, ErrReset)
+	}
+
+	var got int
+	buf := make([]byte, 4000)
+	for {
+		n, err = peer.Read(buf)
+		got += n
+		if err != nil {
+			break
+		}
+	}
+	if got > 1000 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("peer read %d bytes and %v; want at most 1000 and a reset", got, err)
+	}
+	if _, err = c.Write(buf); !errors.Is(err, ErrReset) {
+		t.Errorf("Write after reset: %v, want %v", err, ErrReset)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	c, _ := pair(t, Profile{Delay: time.Millisecond}, Profile{})
+	t0 := time.Now()
+	c.SetReadDeadline(t0.Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Read: %v, want a timeout", err)
+	}
+	atleast(t, "Read", time.Since(t0), 50*time.Millisecond)
+}
+
+func TestCloseDelivers(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Rate: 1 << 20})
+	want := bytes.Repeat([]byte("tcpmeter"), 32<<10)
+	if _, err := c.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("peer read %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	raw, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Conn(raw, Profile{}, Profile{Delay: time.Second})
+	defer c.Close()
+	c.SetProfile(Profile{}, Profile{Delay: 20 * time.Millisecond})
+
+	b := []byte{1}
+	t0 := time.Now()
+	c.Write(b)
+	if _, err := peer.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	atleast(t, "write after SetProfile", time.Since(t0), 20*time.Millisecond)
+
+	c.SetProfile(Profile{}, Profile{Reset: 1})
+	if _, err := c.Write(b); !errors.Is(err, ErrReset) {
+		t.Errorf("Write past a lowered Reset: %v, want %v", err, ErrReset)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	c, peer := pair(t, Profile{}, Profile{Rate: 256 << 10})
+	want := make([]byte, 256<<10) // a second's worth
+	c.Write(want)
+	c.(Impaired).CloseWrite()
+	if _, err := c.Write(want); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after CloseWrite: %v, want %v", err, net.ErrClosed)
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("peer read %d bytes and %v, want %d and EOF", len(got), err, len(want))
+	}
+	// the other way still works
+	peer.Write([]byte{1})
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,21 +4,64 @@ import (
 	"log"
 )
 
-// Continually log any stats, provide them on an output channel
-// to downstream receivers (usually a CStatHandler)
-func LogClient(si chan Stats, so chan Stats) {
+// Continually log any stats and publish them to the hub, from where
+// they reach every viewer of the web UI
+func LogClient(si chan Stats, hub *Hub) {
 	log.Println("LogClient started...")
 	for {
 		stats, ok := <-si
 		if !ok {
 			log.Fatal("receive failed")
 		}
-		if stats.Stat == "Running" {
+		note(&stats)
+		hub.Publish(stats)
+	}
+}
+
+// note traces stats, keeps the metrics, history, baselines and tests up to date
+// and raises alerts; it sets Regr on a summary that falls short of its
+// baseline.
+func note(stats *Stats) {
+	if stats.Stat == "Running" {
+		if stats.TPS > 0 {
+			trace.Printf("|TXNS|%s|%.1f|\n", stats.Type, stats.TPS)
+		} else {
 			trace.Printf("|DATA|%s|%d|\n", stats.Type, stats.Rate)
 		}
-		select {
-		case so <- stats:
-		default:
+	}
+	if sm := stats.Sum; sm != nil {
+		trace.Printf("|DONE|%s|%d|%d|%d|%d|%d|%d|%d|%d|%d|\n", stats.Type, sm.Bytes, sm.SrvBytes,
+			sm.Elapsed.Nanoseconds(), sm.Avg, sm.Peak, sm.Min, sm.StdDev, sm.Send, sm.Recv)
+		if l := sm.Lat; l != nil {
+			trace.Printf("|LAT|%s|%d|%.1f|%d|%d|%d|%d|%d|%d|\n", stats.Type, sm.Txns, sm.TPS,
+				l.Min, l.P50, l.P90, l.P99, l.P999, l.Max)
+		}
+		if baselines != nil {
+			if stats.Regr = baselines.Check(stats.Type, sm); stats.Regr != nil {
+				rg := stats.Regr
+				log.Printf("REGRESSION %s %s: %.4g against a baseline of %.4g, %.1f%% down (tolerance %.1f%%)\n",
+					sm.Cfg.Host, stats.Type, rg.Got, rg.Ref, rg.Drop*100, rg.Tol*100)
+				trace.Printf("|REGR|%s|%s|%.0f|%.0f|%.3f|\n", stats.Type, sm.Cfg.Host, rg.Got, rg.Ref, rg.Drop)
+			}
+		}
+		if history != nil {
+			if err := history.Add(Result{Test: stats.Type, Sum: *sm, Regr: stats.Regr}); err != nil {
+				log.Println("history: ", err)
+			}
+		}
+	}
+	record(*stats)
+	if tests != nil {
+		tests.update(stats)
+	}
+	if stats.Stat == "Error" {
+		trace.Printf("|FAIL|%s|%s|%s|%s|\n", stats.Type, stats.Host, stats.Reason, stats.Err)
+	}
+	if alerts != nil {
+		host := stats.Host
+		if stats.Sum != nil {
+			host = stats.Sum.Cfg.Host
 		}
+		alerts.Check(host, stats)
 	}
 }
@@ -1,28 +1,61 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/9nut/tcpmeter/server"
 )
 
 var trace *log.Logger
 
+// how long the server waits for tests under way when it is interrupted
+const shutdownWait = 30 * time.Second
+
 func main() {
-	var cf, sf bool
+	var cf, sf, rf bool
 	var haddr, raddr string
 	var fname, pname string
+	var maddr string
+	var cname, hname, aname string
+	var tname, nsize, tdur string
+	var oname string
+	var xaddr string
+	var bsize string
+	var ncores int
+	var af bool
 	cmdline := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	cmdline.Usage = func() {
-		log.Printf("usage: %s (-c|-s) [-r [host:]port] [-h [host:]port] [-l logfile]\n", os.Args[0])
+		log.Printf("usage: %s (-c|-s|-x target [-R]) [-r [host:]port] [-h [host:]port] [-l logfile] [-m [host:]port] [-f schedule] [-H history] [-a alerts] [-t test [-n size] [-d duration]] [-b size] [-C cores [-A]] [-o report.html [run ...]]\n", os.Args[0])
 	}
 	cmdline.BoolVar(&cf, "c", false, "client mode")
 	cmdline.BoolVar(&sf, "s", false, "server mode")
+	cmdline.StringVar(&xaddr, "x", "", "proxy mode: forward the connections to -r to this address, impaired as set on the WebUI")
+	cmdline.BoolVar(&rf, "R", false, "Relay tcpmeter's RPC, so that the payload of tests is proxied too (proxy mode)")
 	cmdline.StringVar(&raddr, "r", ":8001", "RPC address")
 	cmdline.StringVar(&haddr, "h", ":8080", "Admin WebUI")
 	cmdline.StringVar(&fname, "l", "/tmp/tcpmeter.log", "Log file name")
 	cmdline.StringVar(&pname, "p", "", "CPU profile file")
+	cmdline.StringVar(&cname, "f", "", "Schedule file (client mode)")
+	cmdline.StringVar(&aname, "a", "", "Alert rules file (client mode)")
+	cmdline.StringVar(&hname, "H", "/tmp/tcpmeter.history", "History file (client mode)")
+	cmdline.StringVar(&tname, "t", "", "Run one UP, DOWN, CRR or RR test against the server at -r and exit (client mode)")
+	cmdline.StringVar(&nsize, "n", "100MB", "Amount of data for -t UP or DOWN")
+	cmdline.StringVar(&tdur, "d", "", "Duration of -t CRR or RR")
+	cmdline.StringVar(&bsize, "b", "", "Largest read or write of the payload, such as 4MB (-t UP or DOWN, and server mode); 1MB if not given")
+	cmdline.IntVar(&ncores, "C", 0, "Spread payload connections over this many SO_REUSEPORT listeners, one per core (server mode, Linux)")
+	cmdline.BoolVar(&af, "A", false, "Pin the payload connections of each -C listener to its core (server mode)")
+	cmdline.StringVar(&oname, "o", "", "Write an HTML report of the runs in the history named as arguments, or the latest, and exit (client mode)")
+	cmdline.StringVar(&maddr, "m", "", "Metrics address (server mode); the client serves /metrics on the WebUI")
 
 	cmdline.Parse(os.Args[1:])
 
@@ -36,9 +69,9 @@ func main() {
 		}
 		defer pprof.StopCPUProfile()
 	}
-	if cf == sf {
+	if n := btoi(cf) + btoi(sf) + btoi(xaddr != ""); n != 1 {
 		cmdline.Usage()
-		log.Fatalln("either -s or -c must be specified")
+		log.Fatalln("one of -s, -c or -x must be specified")
 	}
 
 	logfile, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
@@ -50,8 +83,125 @@ func main() {
 	log.SetFlags(log.Flags() | log.Llongfile)
 
 	if cf {
-		ClientMain(haddr)
+		var sched *Schedule
+		if cname != "" {
+			if sched, err = LoadSchedule(cname); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if aname != "" {
+			if alerts, err = LoadAlerts(aname); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if history, err = OpenHistory(hname); err != nil {
+			log.Fatal("OpenHistory failed", err)
+		}
+		if baselines, err = OpenBaselines(hname+".baseline", history); err != nil {
+			log.Fatal("OpenBaselines failed", err)
+		}
+		if oname != "" {
+			rs, err := reportruns(history, cmdline.Args())
+			if err != nil {
+				log.Fatal(err)
+			}
+			f, err := os.Create(oname)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err = Report(f, rs); err != nil {
+				log.Fatal(err)
+			}
+			if err = f.Close(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if tname != "" {
+			host, port, err := net.SplitHostPort(raddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			j := Job{Test: tname, Host: host, Port: port, Size: nsize, Dur: tdur, Buf: bsize}
+			c, err := j.Command()
+			if err != nil {
+				log.Fatal(err)
+			}
+			status := RunOnce(c)
+			pprof.StopCPUProfile()
+			logfile.Close()
+			os.Exit(status)
+		}
+		ClientMain(haddr, sched)
+	} else if sf {
+		var buf uint64
+		if bsize != "" {
+			if buf, err = parsesize(bsize); err != nil || buf == 0 || buf > maxBuf {
+				log.Fatalln("bad -b: must be a size from 1 byte to 1GB")
+			}
+		}
+		if ncores < 0 {
+			log.Fatalln("bad -C: must be a number of cores")
+		}
+		if af && ncores < 2 {
+			log.Fatalln("-A needs -C of 2 or more")
+		}
+		TCPServer(raddr, maddr, server.Options{Buf: int(buf), Cores: ncores, Pin: af})
 	} else {
-		TCPServer(raddr)
+		ProxyMain(raddr, xaddr, haddr, rf)
+	}
+}
+
+// logf is the Logf of the client and server packages; it logs the file and
+// line of their callers, as the rest of the program does.
+func logf(format string, v ...any) {
+	log.Output(3, fmt.Sprintf(format, v...))
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// TCPServer serves tcpmeter clients at raddr, configured by opt, until it
+// is interrupted, and then waits for the tests under way. If maddr isn't
+// empty, it also serves metrics over http at that address.
+func TCPServer(raddr, maddr string, opt server.Options) {
+	servermetrics()
+	if maddr != "" {
+		go func() {
+			err := http.ListenAndServe(maddr, metrics)
+			if err != nil {
+				log.Fatal("ListenAndServe: " + err.Error())
+			}
+		}()
+	}
+
+	l, err := net.Listen("tcp", raddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opt.OnSessionStart, opt.OnSessionEnd, opt.Logf = sessionstart, sessionend, logf
+	srv := server.New(opt)
+
+	// on an interrupt, let the tests under way finish
+	idle := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown: ", err)
+		}
+		close(idle)
+	}()
+	if err = srv.Serve(l); err != server.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-idle
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/9nut/tcpmeter/client"
+	"github.com/9nut/tcpmeter/server"
+)
+
+// Metrics is a small registry of counters and gauges that it serves in the
+// Prometheus text exposition format.
+type Metrics struct {
+	mu   sync.Mutex
+	desc map[string][2]string          // name -> type, help
+	vals map[string]map[string]float64 // name -> labels -> value
+}
+
+// metrics is where both the client and the server keep their numbers.
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		desc: make(map[string][2]string),
+		vals: make(map[string]map[string]float64),
+	}
+}
+
+// Describe declares the type ("counter" or "gauge") and help text of a
+// metric; only described metrics are served.
+func (m *Metrics) Describe(name, typ, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.desc[name] = [2]string{typ, help}
+	if m.vals[name] == nil {
+		m.vals[name] = make(map[string]float64)
+	}
+}
+
+// Set sets the value of metric name with the given labels, as made by Labels.
+func (m *Metrics) Set(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if vs := m.vals[name]; vs != nil {
+		vs[labels] = v
+	}
+}
+
+// Add adds v to the value of metric name with the given labels.
+func (m *Metrics) Add(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if vs := m.vals[name]; vs != nil {
+		vs[labels] += v
+	}
+}
+
+var lblesc = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Labels formats key, value pairs as a Prometheus label set.
+func Labels(kv ...string) string {
+	var s []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		s = append(s, kv[i]+`="`+lblesc.Replace(kv[i+1])+`"`)
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
+// ServeHTTP writes all metrics in the text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.desc))
+	for n := range m.desc {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		d := m.desc[n]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", n, d[1], n, d[0])
+		lbls := make([]string, 0, len(m.vals[n]))
+		for l := range m.vals[n] {
+			lbls = append(lbls, l)
+		}
+		sort.Strings(lbls)
+		for _, l := range lbls {
+			fmt.Fprintf(w, "%s%s %g\n", n, l, m.vals[n][l])
+		}
+	}
+}
+
+// failreason classifies err for Stats and the failure metrics.
+func failreason(err error) string {
+	if errors.Is(err, client.ErrUnknownTest) {
+		return "command"
+	}
+	return string(client.ReasonOf(err))
+}
+
+// client side metrics, kept up to date by LogClient
+func clientmetrics() {
+	metrics.Describe("tcpmeter_client_throughput_last_bps", "gauge", "Most recent moving average throughput in bits per second, by direction.")
+	metrics.Describe("tcpmeter_client_throughput_avg_bps", "gauge", "Overall average throughput of the last completed test in bits per second, by direction.")
+	metrics.Describe("tcpmeter_client_transactions_per_second", "gauge", "Transaction rate of the last completed CRR or RR test.")
+	metrics.Describe("tcpmeter_client_rtt_seconds", "gauge", "Round trip time quantiles of the last completed RR test.")
+	metrics.Describe("tcpmeter_client_tests_total", "counter", "Completed tests.")
+	metrics.Describe("tcpmeter_client_failures_total", "counter", "Failed tests by reason.")
+}
+
+// server side metrics, kept up to date by sessionstart and sessionend
+func servermetrics() {
+	metrics.Describe("tcpmeter_server_sessions_active", "gauge", "Payload transfers in progress.")
+	metrics.Describe("tcpmeter_server_sessions_total", "counter", "Payload transfers started, by method.")
+	metrics.Describe("tcpmeter_server_bytes_total", "counter", "Payload bytes moved, by direction.")
+	metrics.Describe("tcpmeter_server_failures_total", "counter", "Failed payload transfers by reason.")
+	metrics.Describe("tcpmeter_server_cpu_busy_ratio", "gauge", "Busy fraction of each core during the last payload transfer.")
+}
+
+// record updates the client metrics from a Stats message.
+func record(st Stats) {
+	dir := Labels("direction", st.Type)
+	test := Labels("test", st.Type)
+	switch st.Stat {
+	case "Running":
+		if st.TPS == 0 {
+			metrics.Set("tcpmeter_client_throughput_last_bps", dir, float64(st.Rate))
+		}
+	case "Done":
+		metrics.Add("tcpmeter_client_tests_total", test, 1)
+		sm := st.Sum
+		if sm == nil {
+			break
+		}
+		if sm.Lat == nil {
+			metrics.Set("tcpmeter_client_throughput_avg_bps", dir, float64(sm.Avg))
+			break
+		}
+		metrics.Set("tcpmeter_client_transactions_per_second", test, sm.TPS)
+		if st.Type == "RR" {
+			q := map[string]float64{
+				"0.5":   sm.Lat.P50.Seconds(),
+				"0.9":   sm.Lat.P90.Seconds(),
+				"0.99":  sm.Lat.P99.Seconds(),
+				"0.999": sm.Lat.P999.Seconds(),
+			}
+			for k, v := range q {
+				metrics.Set("tcpmeter_client_rtt_seconds", Labels("quantile", k), v)
+			}
+		}
+	case "Error":
+		metrics.Add("tcpmeter_client_failures_total", Labels("test", st.Type, "reason", st.Reason), 1)
+	}
+}
+
+// sessionstart and sessionend keep the server metrics up to date.
+func sessionstart(ss server.Session) {
+	metrics.Add("tcpmeter_server_sessions_active", "", 1)
+	metrics.Add("tcpmeter_server_sessions_total", Labels("method", ss.Method), 1)
+}
+
+func sessionend(ss server.Session) {
+	metrics.Add("tcpmeter_server_sessions_active", "", -1)
+	metrics.Add("tcpmeter_server_bytes_total", Labels("direction", "sent"), float64(ss.Sent))
+	metrics.Add("tcpmeter_server_bytes_total", Labels("direction", "received"), float64(ss.Received))
+	for i, u := range ss.CPU {
+		metrics.Set("tcpmeter_server_cpu_busy_ratio", Labels("cpu", strconv.Itoa(i)), u)
+	}
+	if ss.Err != nil {
+		metrics.Add("tcpmeter_server_failures_total", Labels("reason", failreason(ss.Err)), 1)
+	}
+}
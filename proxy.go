@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/9nut/tcpmeter/impair"
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// Impairment is what a Proxy does to the traffic it forwards: Up is the
+// way from its clients to the target and Down the way back.
+type Impairment struct {
+	Up, Down impair.Profile
+}
+
+// Proxy forwards the TCP connections it accepts to Target, impaired. With
+// Relay, its clients are tcpmeter clients and Target a tcpmeter server:
+// the proxy relays their RPC, so that their payload goes through it too.
+type Proxy struct {
+	Target string
+	Relay  bool
+
+	mu    sync.Mutex
+	imp   Impairment
+	conns map[impair.Impaired]struct{} // client ends of what is forwarded
+}
+
+func NewProxy(target string, relay bool) *Proxy {
+	return &Proxy{Target: target, Relay: relay, conns: make(map[impair.Impaired]struct{})}
+}
+
+// Impairment returns the current impairment and the number of connections
+// under it.
+func (p *Proxy) Impairment() (Impairment, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.imp, len(p.conns)
+}
+
+// SetImpairment changes the impairment of new connections and of those
+// already forwarded.
+func (p *Proxy) SetImpairment(imp Impairment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.imp = imp
+	for c := range p.conns {
+		c.SetProfile(imp.Up, imp.Down)
+	}
+}
+
+// impair returns c impaired; the returned function forgets and closes it.
+func (p *Proxy) impair(c net.Conn) (net.Conn, func()) {
+	p.mu.Lock()
+	ic := impair.Conn(c, p.imp.Up, p.imp.Down)
+	p.conns[ic] = struct{}{}
+	p.mu.Unlock()
+	return ic, func() {
+		p.mu.Lock()
+		delete(p.conns, ic)
+		p.mu.Unlock()
+		ic.Close()
+	}
+}
+
+// Serve forwards the connections accepted by l until accepting fails.
+func (p *Proxy) Serve(l net.Listener) error {
+	log.Println("Proxying ", l.Addr(), " to ", p.Target)
+	return p.accept(l, func(c net.Conn) {
+		if p.Relay {
+			p.relay(c)
+		} else {
+			p.forward(c, p.Target)
+		}
+	})
+}
+
+func (p *Proxy) accept(l net.Listener, serve func(net.Conn)) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serve(c)
+	}
+}
+
+// forward copies c to and from a connection to addr, passing on the end of
+// each way as the other end sees it, until both are done.
+func (p *Proxy) forward(c net.Conn, addr string) {
+	t, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		log.Println("proxy: ", err)
+		c.Close()
+		return
+	}
+	defer t.Close()
+	c, done := p.impair(c)
+	defer done()
+
+	up := make(chan struct{})
+	go func() {
+		io.Copy(t, c)
+		closewrite(t)
+		close(up)
+	}()
+	io.Copy(c, t)
+	closewrite(c)
+	<-up
+}
+
+// closewrite shuts down the writing side of c, or closes it if it can't.
+func closewrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// relay serves the RPC of the tcpmeter client on c by passing it on to the
+// target.
+func (p *Proxy) relay(c net.Conn) {
+	t, err := net.DialTimeout("tcp", p.Target, 5*time.Second)
+	if err != nil {
+		log.Println("proxy: ", err)
+		c.Close()
+		return
+	}
+	host, _, _ := net.SplitHostPort(p.Target)
+	lhost, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	r := &Relay{p: p, host: host, lhost: lhost, rpc: rpc.NewClient(t)}
+	defer r.rpc.Close()
+	defer r.stop()
+
+	c, done := p.impair(c)
+	defer done()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("TCPPerf", r); err != nil {
+		panic(err)
+	}
+	srv.ServeConn(c)
+}
+
+// Relay is the TCPPerf of a tcpmeter server as a client of a Proxy sees
+// it: each call is passed on to the server, and the payload is forwarded
+// through the proxy from a listener of its own.
+type Relay struct {
+	p     *Proxy
+	host  string // of the server
+	lhost string // to listen for payload on
+	rpc   *rpc.Client
+
+	mu sync.Mutex
+	l  net.Listener // payload listener, from TCPStart to TCPStop
+}
+
+// TCPStart starts a test on the server and listens for its payload.
+func (r *Relay) TCPStart(n int, port *string) error {
+	var sport string
+	if err := r.rpc.Call("TCPPerf.TCPStart", n, &sport); err != nil {
+		return err
+	}
+	r.stop()
+	l, err := net.Listen("tcp", net.JoinHostPort(r.lhost, "0"))
+	if err != nil {
+		log.Println("Listen: ", err)
+		return err
+	}
+	r.mu.Lock()
+	r.l = l
+	r.mu.Unlock()
+	*port = fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	addr := net.JoinHostPort(r.host, sport)
+	go r.p.accept(l, func(c net.Conn) { r.p.forward(c, addr) })
+	log.Println("Relaying payload port ", *port, " to ", addr)
+	return nil
+}
+
+// TCPStop stops listening for payload and passes the call on.
+func (r *Relay) TCPStop(n int, rep *bool) error {
+	r.stop()
+	return r.rpc.Call("TCPPerf.TCPStop", n, rep)
+}
+
+func (r *Relay) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.l != nil {
+		r.l.Close()
+		r.l = nil
+	}
+}
+
+func (r *Relay) TCPRcv(n uint64, res *stats.XferResult) error {
+	return r.rpc.Call("TCPPerf.TCPRcv", n, res)
+}
+
+func (r *Relay) TCPSnd(n uint64, res *stats.XferResult) error {
+	return r.rpc.Call("TCPPerf.TCPSnd", n, res)
+}
+
+func (r *Relay) TCPCrr(n uint64, res *uint64) error {
+	return r.rpc.Call("TCPPerf.TCPCrr", n, res)
+}
+
+func (r *Relay) TCPCpy(n uint64, res *uint64) error {
+	return r.rpc.Call("TCPPerf.TCPCpy", n, res)
+}
+
+func (r *Relay) TCPRR(sz stats.TxnSize, res *uint64) error {
+	return r.rpc.Call("TCPPerf.TCPRR", sz, res)
+}
+
+// JSONProfile is a Profile with rates in Mbps, times in milliseconds and
+// loss in percent.
+type JSONProfile struct {
+	Rate   float64
+	Delay  float64
+	Jitter float64
+	Loss   float64
+	Stall  float64
+	Reset  uint64
+}
+
+type JSONImpairment struct {
+	Up, Down JSONProfile
+	Conns    int
+}
+
+func jsonprofile(p *impair.Profile) JSONProfile {
+	return JSONProfile{Rate: float64(p.Rate) * 8 / 1e6, Delay: ms(p.Delay), Jitter: ms(p.Jitter),
+		Loss: p.Loss * 100, Stall: ms(p.Stall), Reset: p.Reset}
+}
+
+// ImpairHandler shows and changes the impairment of a Proxy over http at
+// /impair. GET returns it; POST changes the fields given, named up. or
+// down. and rate (Mbps), delay, jitter, stall (ms), loss (percent) or
+// reset (a size, 0 for never), and returns the result.
+type ImpairHandler struct {
+	P *Proxy
+}
+
+func (ih *ImpairHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		imp, _ := ih.P.Impairment()
+		for _, d := range []struct {
+			name string
+			p    *impair.Profile
+		}{{"up.", &imp.Up}, {"down.", &imp.Down}} {
+			if err := formprofile(r, d.name, d.p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ih.P.SetImpairment(imp)
+		log.Println("Impairment set: ", imp)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	imp, n := ih.P.Impairment()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JSONImpairment{Up: jsonprofile(&imp.Up), Down: jsonprofile(&imp.Down), Conns: n})
+}
+
+// formprofile sets the fields of p given in the form of r with prefix.
+func formprofile(r *http.Request, prefix string, p *impair.Profile) error {
+	num := func(name string, set func(float64)) error {
+		s := r.FormValue(prefix + name)
+		if s == "" {
+			return nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("bad %s%s: %s", prefix, name, s)
+		}
+		set(v)
+		return nil
+	}
+	dur := func(v float64) time.Duration { return time.Duration(v * float64(time.Millisecond)) }
+	for _, err := range []error{
+		num("rate", func(v float64) { p.Rate = uint64(v * 1e6 / 8) }),
+		num("delay", func(v float64) { p.Delay = dur(v) }),
+		num("jitter", func(v float64) { p.Jitter = dur(v) }),
+		num("stall", func(v float64) { p.Stall = dur(v) }),
+		num("loss", func(v float64) { p.Loss = min(v, 100) / 100 }),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if s := r.FormValue(prefix + "reset"); s != "" {
+		n, err := parsesize(s)
+		if err != nil {
+			return fmt.Errorf("bad %sreset: %s", prefix, s)
+		}
+		p.Reset = n
+	}
+	return nil
+}
+
+// ProxyMain forwards the connections to laddr to target, and serves the
+// page that controls their impairment over http at haddr.
+func ProxyMain(laddr, target, haddr string, relay bool) {
+	p := NewProxy(target, relay)
+	http.Handle("/impair", &ImpairHandler{p})
+	http.Handle("/ui/", http.FileServer(http.FS(uifiles)))
+	http.Handle("/", page("ui/proxy.html"))
+	go func() {
+		err := http.ListenAndServe(haddr, nil)
+		if err != nil {
+			log.Fatal("ListenAndServe: " + err.Error())
+		}
+	}()
+
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(p.Serve(l))
+}
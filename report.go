@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// series is one line of a chart, or one colour of bars.
+type series struct {
+	Name string
+	X, Y []float64
+}
+
+var palette = []string{"#3366cc", "#dc3912", "#ff9900", "#109618", "#990099"}
+
+// chart dimensions and margins
+const (
+	svgW, svgH = 720, 260
+	svgL, svgR = 64, 16
+	svgT, svgB = 28, 48
+)
+
+// nicestep rounds span/n up to 1, 2 or 5 times a power of ten.
+func nicestep(span float64, n int) float64 {
+	raw := span / float64(n)
+	if !(raw > 0) {
+		return 1
+	}
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	switch f := raw / mag; {
+	case f <= 1:
+		return mag
+	case f <= 2:
+		return 2 * mag
+	case f <= 5:
+		return 5 * mag
+	}
+	return 10 * mag
+}
+
+func fmtnum(v float64) string {
+	if math.Abs(v) >= 1000 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.3g", v)
+}
+
+// svgframe starts an svg chart with its title, y axis label and grid
+// up to y1, and returns the rounded up top of the y axis.
+func svgframe(b *strings.Builder, title, ylabel string, y1 float64) float64 {
+	step := nicestep(y1, 5)
+	y1 = math.Max(math.Ceil(y1/step)*step, step)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		svgW, svgH, svgW, svgH)
+	fmt.Fprintf(b, `<text x="%d" y="16" text-anchor="middle" font-weight="bold" font-size="12">%s</text>`,
+		svgW/2, html.EscapeString(title))
+	fmt.Fprintf(b, `<text transform="translate(14 %d) rotate(-90)" text-anchor="middle" fill="#444">%s</text>`,
+		(svgT+svgH-svgB)/2, html.EscapeString(ylabel))
+	for y := 0.0; y <= y1+step/2; y += step {
+		py := svgH - svgB - y/y1*(svgH-svgT-svgB)
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#e4e4e4"/>`, svgL, py, svgW-svgR, py)
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle" fill="#444">%s</text>`,
+			svgL-4, py, fmtnum(y))
+	}
+	fmt.Fprintf(b, `<path d="M%d %d V%d H%d" fill="none" stroke="#888"/>`, svgL, svgT, svgH-svgB, svgW-svgR)
+	return y1
+}
+
+// svglegend ends a chart with a legend of ss, if there is more than one.
+func svglegend(b *strings.Builder, ss []series) {
+	if len(ss) > 1 {
+		x := svgL
+		for i, s := range ss {
+			fmt.Fprintf(b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, x, svgH-14, palette[i%len(palette)])
+			fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, x+14, svgH-5, html.EscapeString(s.Name))
+			x += 30 + 7*len(s.Name)
+		}
+	}
+	b.WriteString(`</svg>`)
+}
+
+// linechart draws ss against a numeric x axis from 0.
+func linechart(title, xlabel, ylabel string, ss []series) template.HTML {
+	var x1, y1 float64
+	for _, s := range ss {
+		for i := range s.X {
+			x1, y1 = math.Max(x1, s.X[i]), math.Max(y1, s.Y[i])
+		}
+	}
+	var b strings.Builder
+	y1 = svgframe(&b, title, ylabel, y1)
+	xstep := nicestep(x1, 8)
+	x1 = math.Max(math.Ceil(x1/xstep)*xstep, xstep)
+	px := func(x float64) float64 { return svgL + x/x1*(svgW-svgL-svgR) }
+	py := func(y float64) float64 { return svgH - svgB - y/y1*(svgH-svgT-svgB) }
+	for x := 0.0; x <= x1+xstep/2; x += xstep {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle" fill="#444">%s</text>`, px(x), svgH-svgB+14, fmtnum(x))
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" fill="#444">%s</text>`,
+		(svgL+svgW-svgR)/2, svgH-svgB+28, html.EscapeString(xlabel))
+	for i, s := range ss {
+		var pts []string
+		for j := range s.X {
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", px(s.X[j]), py(s.Y[j])))
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`,
+			strings.Join(pts, " "), palette[i%len(palette)])
+	}
+	svglegend(&b, ss)
+	return template.HTML(b.String())
+}
+
+// barchart draws a group of bars for each of cats, one from each of ss.
+func barchart(title, ylabel string, cats []string, ss []series) template.HTML {
+	var y1 float64
+	for _, s := range ss {
+		for _, y := range s.Y {
+			y1 = math.Max(y1, y)
+		}
+	}
+	var b strings.Builder
+	y1 = svgframe(&b, title, ylabel, y1)
+	gw := float64(svgW-svgL-svgR) / float64(max(len(cats), 1))
+	bw := gw * 0.8 / float64(max(len(ss), 1))
+	for j, c := range cats {
+		x := svgL + float64(j)*gw + gw*0.1
+		for i, s := range ss {
+			h := s.Y[j] / y1 * (svgH - svgT - svgB)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s</title></rect>`,
+				x+float64(i)*bw, svgH-svgB-h, bw, h, palette[i%len(palette)], fmtnum(s.Y[j]))
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle" fill="#444">%s</text>`,
+			x+gw*0.4, svgH-svgB+14, html.EscapeString(c))
+	}
+	svglegend(&b, ss)
+	return template.HTML(b.String())
+}
+
+// timeline returns the client and server timelines of r as series.
+func timeline(r *Result) []series {
+	var cli, srv series
+	cli.Name, srv.Name = "Client", "Server"
+	for _, s := range samples(r) {
+		p := &cli
+		if s.Side == "server" {
+			p = &srv
+		}
+		p.X = append(p.X, s.Elapsed)
+		p.Y = append(p.Y, s.Rate)
+	}
+	if len(srv.X) == 0 {
+		return []series{cli}
+	}
+	return []series{cli, srv}
+}
+
+// histogram charts the latency histogram of a CRR or RR run.
+func histogram(r *Result) template.HTML {
+	l := r.Sum.Lat
+	if l == nil || len(l.Hist) == 0 {
+		return ""
+	}
+	what := "Round trip time"
+	if r.Test == "CRR" {
+		what = "Handshake time"
+	}
+	var cats []string
+	s := series{Name: "Transactions"}
+	for i, n := range l.Hist {
+		lo := "0"
+		if i > 0 {
+			lo = (time.Duration(1<<i) * time.Microsecond).String()
+		}
+		cats = append(cats, lo)
+		s.Y = append(s.Y, float64(n))
+	}
+	return barchart(what+" (from)", "Transactions", cats, []series{s})
+}
+
+// ends compares the whole transfer rate of an UP or DOWN run as the sender
+// and the receiver saw it, if both are known.
+func ends(r *Result) template.HTML {
+	if r.Sum.Lat != nil || r.Sum.Send == 0 || r.Sum.Recv == 0 {
+		return ""
+	}
+	return barchart("Sender vs Receiver", "Megabits / Second", []string{"whole transfer"}, []series{
+		{Name: "Sender", Y: []float64{r.Sum.Send.Mbps()}},
+		{Name: "Receiver", Y: []float64{r.Sum.Recv.Mbps()}},
+	})
+}
+
+// reportRun is a run as the report template sees it.
+type reportRun struct {
+	*Result
+	Title     string
+	Value     string
+	Rows      [][]string
+	Timeline  template.HTML
+	Histogram template.HTML
+	Ends      template.HTML
+}
+
+var reportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tcpmeter report</title>
+<style>
+body { font: 13px/1.3 arial, helvetica, sans-serif; margin: 16px; }
+table { border-collapse: collapse; margin: 8px 0; }
+td, th { padding: 2px 8px; text-align: left; border-bottom: 1px solid #eee; }
+section { margin-top: 24px; }
+.regr { color: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>tcpmeter report</h1>
+<p>Generated {{.Now}}</p>
+<table>
+<tr><th>Run</th><th>Finished</th><th>Server</th><th>Test</th><th>Result</th></tr>
+{{range .Runs}}<tr><td><a href="#{{.ID}}">{{.ID}}</a></td><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Sum.Cfg.Host}}</td><td>{{.Test}}</td><td>{{.Value}}{{if .Regr}} <span class="regr">regression</span>{{end}}</td></tr>
+{{end}}</table>
+{{range .Runs}}
+<section id="{{.ID}}">
+<h2>{{.Title}}</h2>
+<table>
+<tr><th>Field</th><th>Value</th><th>Unit</th></tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{.Timeline}}
+{{.Histogram}}
+{{.Ends}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+// Report writes a self-contained HTML report of rs, with its charts drawn
+// as inline SVG, so that it can be attached to a ticket and read anywhere.
+func Report(w io.Writer, rs []Result) error {
+	if len(rs) == 0 {
+		return errors.New("no runs to report")
+	}
+	var runs []reportRun
+	for i := range rs {
+		r := &rs[i]
+		unit, value := "Megabits / Second", fmt.Sprintf("%.2f Mbps", r.Sum.Avg.Mbps())
+		if r.Sum.Lat != nil {
+			unit, value = "Transactions / Second", fmt.Sprintf("%.1f /s", r.Sum.TPS)
+		}
+		title := fmt.Sprintf("%s %s %s", r.Sum.Cfg.Host, r.Test, r.Time.Format("2006-01-02 15:04:05"))
+		runs = append(runs, reportRun{
+			Result:    r,
+			Title:     title,
+			Value:     value,
+			Rows:      summary(r),
+			Timeline:  linechart(title, "Seconds", unit, timeline(r)),
+			Histogram: histogram(r),
+			Ends:      ends(r),
+		})
+	}
+	return reportTmpl.Execute(w, struct {
+		Now  string
+		Runs []reportRun
+	}{time.Now().Format(time.RFC1123), runs})
+}
+
+// reportruns returns the runs with the given ids, or the latest if none are given.
+func reportruns(h *History, ids []string) ([]Result, error) {
+	all, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		if len(all) == 0 {
+			return nil, errors.New("the history is empty")
+		}
+		return all[len(all)-1:], nil
+	}
+	byid := make(map[string]Result, len(all))
+	for _, r := range all {
+		byid[r.ID] = r
+	}
+	var rs []Result
+	for _, id := range ids {
+		r, ok := byid[id]
+		if !ok {
+			return nil, errors.New("no such run: " + id)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// ReportHandler serves the report of the runs given by the id parameters
+// at /report.
+type ReportHandler struct {
+	H *History
+}
+
+func (rh *ReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	rs, err := reportruns(rh.H, r.Form["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = Report(w, rs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
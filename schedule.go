@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+// largest Buf of a Job
+const maxBuf = 1 << 30
+
+// Job is one test of a schedule, or one submitted through the API.
+type Job struct {
+	Test   string // UP, DOWN, CRR or RR
+	Host   string
+	Port   string  // RPC port; 8001 if empty
+	Size   string  // amount of data for UP and DOWN tests, e.g. "100MB"
+	Dur    string  // length of CRR and RR tests, e.g. "10s"
+	Omit   string  // warm-up to leave out of UP and DOWN averages, e.g. "2s"
+	Steady float64 // percent deviation below which UP and DOWN rates are steady
+	Stop   bool    // end UP and DOWN tests once steady
+	Req    *uint64 // RR request size; 1 byte if absent
+	Resp   *uint64 // RR response size; 1 byte if absent
+	Buf    string  // largest read or write of UP and DOWN payload, e.g. "4MB"; 1MB if empty
+}
+
+// JobError lists everything wrong with a Job, one field per entry.
+type JobError []string
+
+func (e JobError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Schedule configures unattended monitoring. It is read from a JSON file
+// such as
+//
+//	{
+//		"Cron": "*/30 * * * *",
+//		"Jobs": [
+//			{"Test": "DOWN", "Host": "lab1", "Size": "200MB", "Omit": "2s"},
+//			{"Test": "UP", "Host": "lab1", "Size": "200MB", "Omit": "2s"},
+//			{"Test": "RR", "Host": "lab2", "Dur": "10s"}
+//		]
+//	}
+//
+// Every, a duration such as "15m", may be given instead of Cron.
+type Schedule struct {
+	Every string
+	Cron  string
+	Jobs  []Job
+
+	every time.Duration
+	cron  *Cron
+	cmds  []Command
+}
+
+// parsesize parses an amount of data such as "100MB"; a bare number is in bytes.
+func parsesize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	m := uint64(1)
+	for u, x := range Mult {
+		if strings.HasSuffix(s, u) {
+			s, m = strings.TrimSpace(strings.TrimSuffix(s, u)), x
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/m {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * m, nil
+}
+
+// Command converts j to the Command that TCPClient runs. Its error, if
+// any, is a JobError.
+func (j *Job) Command() (Command, error) {
+	var bad JobError
+	var err error
+	c := Command{Name: j.Test, Cfg: stats.Config{Host: j.Host, RPCPort: j.Port,
+		Steady: j.Steady / 100, Stop: j.Stop}}
+	if c.Cfg.RPCPort == "" {
+		c.Cfg.RPCPort = "8001"
+	}
+	switch j.Test {
+	case "UP", "DOWN":
+		if c.Cfg.Count, err = parsesize(j.Size); err != nil {
+			bad = append(bad, "Size: "+err.Error())
+		} else if c.Cfg.Count == 0 {
+			bad = append(bad, "Size: must be more than zero")
+		}
+		if j.Omit != "" {
+			if c.Cfg.Omit, err = time.ParseDuration(j.Omit); err != nil || c.Cfg.Omit < 0 {
+				bad = append(bad, fmt.Sprintf("Omit: bad duration %q", j.Omit))
+			}
+		}
+		if j.Steady < 0 || j.Steady >= 100 {
+			bad = append(bad, "Steady: must be a percentage from 0 to 100")
+		}
+		if j.Stop && j.Steady == 0 {
+			bad = append(bad, "Stop: needs Steady")
+		}
+		if j.Buf != "" {
+			if c.Cfg.Buf, err = parsesize(j.Buf); err != nil {
+				bad = append(bad, "Buf: "+err.Error())
+			} else if c.Cfg.Buf == 0 || c.Cfg.Buf > maxBuf {
+				bad = append(bad, "Buf: must be from 1 byte to 1GB")
+			}
+		}
+	case "CRR", "RR":
+		if j.Dur != "" {
+			if c.Cfg.Dur, err = time.ParseDuration(j.Dur); err != nil || c.Cfg.Dur < 0 {
+				bad = append(bad, fmt.Sprintf("Dur: bad duration %q", j.Dur))
+			}
+		}
+	case "":
+		bad = append(bad, "Test: missing; use UP, DOWN, CRR or RR")
+	default:
+		bad = append(bad, fmt.Sprintf("Test: unknown test %q; use UP, DOWN, CRR or RR", j.Test))
+	}
+	for _, f := range []struct {
+		name string
+		n    *uint64
+		to   *uint64
+	}{{"Req", j.Req, &c.Cfg.Req}, {"Resp", j.Resp, &c.Cfg.Resp}} {
+		if f.n == nil {
+			continue
+		}
+		if *f.n == 0 || *f.n > stats.MaxTxn {
+			bad = append(bad, fmt.Sprintf("%s: must be from 1 to %d bytes", f.name, stats.MaxTxn))
+			continue
+		}
+		*f.to = *f.n
+	}
+	if j.Host == "" {
+		bad = append(bad, "Host: missing")
+	} else if !validhost(j.Host) {
+		bad = append(bad, fmt.Sprintf("Host: bad host %q", j.Host))
+	}
+	if p, err := strconv.Atoi(c.Cfg.RPCPort); err != nil || p < 1 || p > 65535 {
+		bad = append(bad, fmt.Sprintf("Port: bad port %q", c.Cfg.RPCPort))
+	}
+	if len(bad) > 0 {
+		return c, bad
+	}
+	return c, nil
+}
+
+// LoadSchedule reads and checks the schedule in the file at path.
+func LoadSchedule(path string) (*Schedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := new(Schedule)
+	if err = json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch {
+	case s.Cron != "" && s.Every != "":
+		return nil, errors.New(path + ": give one of Every or Cron")
+	case s.Cron != "":
+		if s.cron, err = ParseCron(s.Cron); err != nil {
+			return nil, err
+		}
+	case s.Every != "":
+		if s.every, err = time.ParseDuration(s.Every); err != nil {
+			return nil, err
+		}
+		if s.every <= 0 {
+			return nil, errors.New(path + ": Every must be positive")
+		}
+	default:
+		return nil, errors.New(path + ": give one of Every or Cron")
+	}
+	for i := range s.Jobs {
+		c, err := s.Jobs[i].Command()
+		if err != nil {
+			return nil, fmt.Errorf("%s: job %d: %v", path, i+1, err)
+		}
+		s.cmds = append(s.cmds, c)
+	}
+	return s, nil
+}
+
+// next returns when the jobs should run next after t.
+func (s *Schedule) next(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.Next(t)
+	}
+	return t.Add(s.every)
+}
+
+// Scheduler queues the jobs of s on cch each time they are due. The jobs
+// of a server run one after another, between any started from the web UI,
+// and their results land in the history like any other.
+func Scheduler(s *Schedule, cch chan<- Command) {
+	log.Println("Scheduler started with ", len(s.cmds), " jobs")
+	for {
+		t := s.next(time.Now())
+		if t.IsZero() {
+			log.Println("Scheduler: ", s.Cron, " never matches")
+			return
+		}
+		time.Sleep(time.Until(t))
+		for _, c := range s.cmds {
+			trace.Printf("|SCHED|%s|%s|\n", c.Name, c.Cfg.Host)
+			cch <- c
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/9nut/tcpmeter/stats"
+)
+
+func TestJobTxnSize(t *testing.T) {
+	size := func(n uint64) *uint64 { return &n }
+	for _, c := range []struct {
+		req, resp *uint64
+		ok        bool
+	}{
+		{nil, nil, true},
+		{size(1), size(stats.MaxTxn), true},
+		{size(0), nil, false},
+		{nil, size(0), false},
+		{size(stats.MaxTxn + 1), nil, false},
+		{nil, size(1e18), false},
+	} {
+		j := Job{Test: "RR", Host: "lab1", Req: c.req, Resp: c.resp}
+		if _, err := j.Command(); (err == nil) != c.ok {
+			t.Errorf("RR of request %v and response %v: %v", c.req, c.resp, err)
+		}
+	}
+}
+
+func TestJobHost(t *testing.T) {
+	for h, ok := range map[string]bool{
+		"lab1": true, "lab1.example.com": true, "192.0.2.1": true, "::1": true,
+		"": false, "-lab1": false, "lab1..com": false, "lab 1": false,
+		"<script>alert(1)</script>": false, "../../etc": false, "lab1:8001": false,
+	} {
+		j := Job{Test: "DOWN", Host: h, Size: "1MB"}
+		if _, err := j.Command(); (err == nil) != ok {
+			t.Errorf("host %q: %v", h, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]uint64{"100": 100, "2KB": 2048, "3 MB": 3 << 20, "1GB": 1 << 30} {
+		if n, err := parsesize(s); err != nil || n != want {
+			t.Errorf("parsesize(%q) = %d, %v, want %d", s, n, err, want)
+		}
+	}
+	for _, s := range []string{"", "x", "-1", "1TB", "20000000000GB"} {
+		if n, err := parsesize(s); err == nil {
+			t.Errorf("parsesize(%q) = %d", s, n)
+		}
+	}
+}
+
+func TestCmdBadForm(t *testing.T) {
+	if trace == nil {
+		trace = log.New(io.Discard, "", 0)
+	}
+	h := &CCmdHandler{} // never reached with a bad form
+	for _, form := range []string{
+		"tstt=RR&raddr=lab1&rport=8001&reqsz=1000000000000000000",
+		"tstt=RR&raddr=lab1&rport=8001&rspsz=0",
+		"tstt=RR&raddr=lab1&rport=8001&reqsz=x",
+		"tstt=UP&raddr=lab1&rport=8001&txsize=10&txmult=MB&txomit=x",
+		"tstt=UP&raddr=lab1&rport=x&txsize=10&txmult=MB",
+		"tstt=UP&raddr=lab1&rport=8001&txsize=10&txmult=PB",
+		"tstt=UP&raddr=lab1&rport=8001&txsize=10&txmult=MB&steady=x",
+		"tstt=UP&raddr=%3Cb%3Elab1&rport=8001&txsize=10&txmult=MB",
+	} {
+		r := httptest.NewRequest("POST", "/cmd", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			q, _ := url.ParseQuery(form)
+			t.Errorf("form %v: status %d, want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// errNoReusePort is the error of listencores where the listeners can't
+// share a port.
+var errNoReusePort = fmt.Errorf("SO_REUSEPORT listeners on %s/%s: %w", runtime.GOOS, runtime.GOARCH, errors.ErrUnsupported)
+
+// corelistener is the payload listener of a server with Options.Cores: as
+// many listeners sharing one port, between which the kernel spreads the
+// connections, each accepting on its own goroutine and, if pinned, serving
+// its connections on its own core.
+type corelistener struct {
+	ls    []net.Listener
+	cpus  []int // to pin the connections of each listener to
+	pin   bool
+	logln func(...any)
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	mu  sync.Mutex
+	dl  time.Time        // of Accept; zero for none
+	cpu map[net.Conn]int // of the connections accepted but not yet pinned
+}
+
+// listencores opens n listeners sharing a port of addr with SO_REUSEPORT.
+func listencores(addr string, n int, pin bool, logln func(...any)) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseport}
+	cpus := allowedcpus()
+	l := &corelistener{pin: pin, logln: logln, conns: make(chan net.Conn),
+		done: make(chan struct{}), cpu: make(map[net.Conn]int)}
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, ln := range l.ls {
+				ln.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = ln.Addr().String() // with the port chosen
+		}
+		l.ls = append(l.ls, ln)
+		l.cpus = append(l.cpus, cpus[i%len(cpus)])
+	}
+	for i := range l.ls {
+		go l.run(i)
+	}
+	return l, nil
+}
+
+// run accepts on the i'th listener until it is closed.
+func (l *corelistener) run(i int) {
+	for {
+		c, err := l.ls[i].Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+			default:
+				l.logln("Accept", err)
+				l.Close()
+			}
+			return
+		}
+		if l.pin {
+			l.mu.Lock()
+			l.cpu[c] = l.cpus[i]
+			l.mu.Unlock()
+		}
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next connection of any of the listeners, or fails
+// once the deadline set before it passes.
+func (l *corelistener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	dl := l.dl
+	l.mu.Unlock()
+	var timeout <-chan time.Time
+	if !dl.IsZero() {
+		t := time.NewTimer(time.Until(dl))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed}
+	case <-timeout:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (l *corelistener) SetDeadline(t time.Time) error {
+	l.mu.Lock()
+	l.dl = t
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *corelistener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		for _, ln := range l.ls {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+func (l *corelistener) Addr() net.Addr { return l.ls[0].Addr() }
+
+// pin binds the calling goroutine to the core of the listener of l that
+// accepted c, if l pins its connections, until the function it returns is
+// called.
+func pin(l net.Listener, c net.Conn) (unpin func()) {
+	unpin = func() {}
+	cl, ok := l.(*corelistener)
+	if !ok {
+		return
+	}
+	cl.mu.Lock()
+	cpu, ok := cl.cpu[c]
+	delete(cl.cpu, c)
+	cl.mu.Unlock()
+	if !ok {
+		return
+	}
+	runtime.LockOSThread()
+	restore, err := bind(cpu)
+	if err != nil {
+		cl.logln("setaffinity: ", err)
+		runtime.UnlockOSThread()
+		return
+	}
+	return func() {
+		if err := restore(); err != nil {
+			// left locked, the thread ends with the goroutine rather
+			// than run others on the one core
+			cl.logln("setaffinity: ", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}
+}
+
+// cputime is how long a core has been busy, and up, in clock ticks.
+type cputime struct {
+	busy, total uint64
+}
+
+// usage returns the fraction of the time between the readings a and b of
+// cputimes that each core was busy; nil if they aren't known.
+func usage(a, b []cputime) []float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return nil
+	}
+	u := make([]float64, len(a))
+	for i := range a {
+		// iowait, and so busy, may step back on some kernels
+		if b[i].total > a[i].total && b[i].busy > a[i].busy {
+			u[i] = min(float64(b[i].busy-a[i].busy)/float64(b[i].total-a[i].total), 1)
+		}
+	}
+	return u
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// cpuset is the mask of sched_setaffinity and sched_getaffinity, for up to
+// 1024 cores.
+type cpuset [16]uint64
+
+// reuseport lets the listeners of listencores share their port.
+func reuseport(_, _ string, c syscall.RawConn) error {
+	if soReusePort == 0 {
+		return errNoReusePort
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
+
+// getaffinity returns the cores that the calling thread may run on.
+func getaffinity() (cpuset, error) {
+	var set cpuset
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if errno != 0 {
+		return set, os.NewSyscallError("sched_getaffinity", errno)
+	}
+	return set, nil
+}
+
+// setaffinity lets the calling thread run only on the cores of set.
+func setaffinity(set *cpuset) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return os.NewSyscallError("sched_setaffinity", errno)
+	}
+	return nil
+}
+
+// bind binds the calling thread to cpu, and returns what lets it run on
+// the cores it could before.
+func bind(cpu int) (func() error, error) {
+	var set cpuset
+	if cpu < 0 || cpu >= len(set)*64 {
+		return nil, syscall.EINVAL
+	}
+	old, err := getaffinity()
+	if err != nil {
+		return nil, err
+	}
+	set[cpu/64] |= 1 << (cpu % 64)
+	if err := setaffinity(&set); err != nil {
+		return nil, err
+	}
+	return func() error { return setaffinity(&old) }, nil
+}
+
+// allowedcpus returns the cores that the process may run on.
+func allowedcpus() []int {
+	var cpus []int
+	if set, err := getaffinity(); err == nil {
+		for i := 0; i < len(set)*64; i++ {
+			if set[i/64]&(1<<(i%64)) != 0 {
+				cpus = append(cpus, i)
+			}
+		}
+	}
+	if len(cpus) == 0 {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus
+}
+
+// cputimes returns the times of each core, by number, from /proc/stat;
+// nil if it can't be read. Busy time is all but idle and iowait.
+func cputimes() []cputime {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var ts []cputime
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fs := strings.Fields(sc.Text())
+		if len(fs) < 6 || !strings.HasPrefix(fs[0], "cpu") || fs[0] == "cpu" {
+			continue
+		}
+		cpu, err := strconv.Atoi(fs[0][3:])
+		if err != nil || cpu < 0 || cpu >= 1<<16 {
+			continue
+		}
+		var t cputime
+		var idle uint64
+		// user nice system idle iowait irq softirq steal; guest time is
+		// counted in user already
+		for i, s := range fs[1:min(len(fs), 9)] {
+			v, _ := strconv.ParseUint(s, 10, 64)
+			t.total += v
+			if i == 3 || i == 4 {
+				idle += v
+			}
+		}
+		t.busy = t.total - idle
+		for len(ts) <= cpu {
+			ts = append(ts, cputime{})
+		}
+		ts[cpu] = t
+	}
+	return ts
+}
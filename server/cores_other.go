@@ -0,0 +1,29 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func reuseport(_, _ string, _ syscall.RawConn) error {
+	return errNoReusePort
+}
+
+func bind(cpu int) (func() error, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func allowedcpus() []int {
+	cpus := make([]int, runtime.NumCPU())
+	for i := range cpus {
+		cpus[i] = i
+	}
+	return cpus
+}
+
+func cputimes() []cputime {
+	return nil
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/9nut/tcpmeter/stats"
+	"github.com/9nut/tcpmeter/xfer"
+)
+
+// meter keeps the timeline of a transfer, sampling its count of bytes
+// moved every Period.
+type meter struct {
+	moved atomic.Uint64
+	seen  uint64 // of moved, at the last sample
+	t0    time.Time
+	stop  chan struct{}
+	done  chan struct{}
+	res   stats.XferResult
+}
+
+func newmeter() *meter {
+	m := &meter{t0: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+func (m *meter) run() {
+	defer close(m.done)
+	t := time.NewTicker(stats.Period)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			m.sample(now.Sub(m.t0))
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *meter) sample(at time.Duration) {
+	n := m.moved.Load()
+	m.res.Timeline = append(m.res.Timeline, stats.Interval{At: at, Bytes: n - m.seen})
+	m.seen = n
+}
+
+// result closes the last period and returns the timeline
+func (m *meter) result() stats.XferResult {
+	close(m.stop)
+	<-m.done
+	m.res.Elapsed = time.Since(m.t0)
+	m.res.Bytes = m.moved.Load()
+	if m.res.Bytes > m.seen {
+		m.sample(m.res.Elapsed)
+	}
+	return m.res
+}
+
+// TCPPerf is the receiver type for TCP Performance RPC methods; each RPC
+// client has its own.
+type TCPPerf struct {
+	host string // to listen for payload on
+	srv  *Server
+
+	mu    sync.Mutex
+	ldata net.Listener // payload data listener, from TCPStart to TCPStop
+}
+
+// listener returns the payload listener, if there is one.
+func (p *TCPPerf) listener() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ldata
+}
+
+// stop closes the payload listener, if there is one.
+func (p *TCPPerf) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ldata != nil {
+		p.ldata.Close()
+		p.ldata = nil
+	}
+}
+
+// TCPStart method prepares the tcp link that will be used for tcp performance testing
+func (p *TCPPerf) TCPStart(_ int, r *string) error {
+	p.srv.logln("TCPStart called")
+	if p.srv.closed() {
+		return ErrServerClosed
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ldata != nil {
+		p.ldata.Close()
+		p.ldata = nil
+	}
+
+	var err error
+	var l net.Listener
+	addr := net.JoinHostPort(p.host, "0") // use any available port for payload
+
+	o := p.srv.opt
+	if o.Cores > 1 {
+		l, err = listencores(addr, o.Cores, o.Pin, p.srv.logln)
+		if errors.Is(err, errors.ErrUnsupported) {
+			p.srv.logln(err, "; using one listener")
+			o.Cores = 0
+		}
+	}
+	if o.Cores <= 1 {
+		l, err = o.Listen("tcp", addr)
+	}
+	if err != nil {
+		p.srv.logln("Listen: ", err)
+		return err
+	}
+	p.ldata = l
+
+	DAddr, ok := l.Addr().(*net.TCPAddr)
+	if ok {
+		*r = fmt.Sprint(DAddr.Port)
+	}
+
+	p.srv.logln("Payload port: ", *r)
+	return nil
+}
+
+// TCPStop method tears down the tcp link that was used for tcp performance testing
+func (p *TCPPerf) TCPStop(_ int, r *bool) error {
+	*r = false
+	p.srv.logln("TCPStop called")
+	p.stop()
+	*r = true
+	return nil
+}
+
+// accept with deadline will do a timed accept of the payload tcp, returning a Conn
+// when possible, and pins the calling goroutine to its core if the server pins
+// until unpin is called
+func (p *TCPPerf) timedaccept() (conn net.Conn, unpin func(), err error) {
+	p.srv.logln("timedaccept called")
+	l := p.listener()
+	if l == nil {
+		err = errors.New("No Payload TCP Listener")
+		p.srv.logln(err)
+		return nil, nil, err
+	}
+
+	// the listeners that can't time out Accept are closed instead
+	if dl, ok := l.(interface{ SetDeadline(time.Time) error }); ok {
+		dl.SetDeadline(time.Now().Add(5 * time.Second))
+	} else {
+		t := time.AfterFunc(5*time.Second, func() {
+			p.srv.logln("Timeout")
+			l.Close()
+		})
+		defer t.Stop()
+	}
+	conn, err = l.Accept()
+	if err != nil {
+		p.srv.logln("Accept", err)
+		return nil, nil, err
+	}
+	return conn, pin(l, conn), nil
+}
+
+// TCPRcv method tries to receive the number of bytes given by the first parameter
+// on a TCP host/port specified in the TCPPerf reciever.  If successful, it will store
+// the number of bytes it actually received and the timeline of their arrival, at the
+// location given by the second parameter.
+func (p *TCPPerf) TCPRcv(n uint64, r *stats.XferResult) (err error) {
+	*r = stats.XferResult{}
+	p.srv.logln("TCPRcv called")
+	ss, err := p.srv.begin("TCPRcv")
+	if err != nil {
+		return err
+	}
+	defer func() { p.srv.end(ss, err) }()
+	conn, unpin, err := p.timedaccept()
+	if err != nil {
+		p.srv.logln("timedaccept", err)
+		return err
+	}
+	defer unpin()
+	defer p.srv.track(conn)()
+
+	m := newmeter()
+	err = xfer.Receive(conn, n, p.srv.opt.Buf, &m.moved)
+	*r = m.result()
+	r.CPU = usage(ss.cpu0, cputimes())
+	ss.Received, ss.CPU = r.Bytes, r.CPU
+	if err != nil {
+		p.srv.logln("Receive error: ", err)
+		return err
+	}
+	return nil
+}
+
+// TCPSnd method tries to send the number of bytes given by the first parameter
+// on a TCP host/port specified in the TCPPerf reciever. It will store the number
+// of bytes it actually sent and the timeline of their departure, at the location given
+// by the second parameter.
+func (p *TCPPerf) TCPSnd(n uint64, r *stats.XferResult) (err error) {
+	*r = stats.XferResult{}
+	p.srv.logln("TCPSnd called")
+	ss, err := p.srv.begin("TCPSnd")
+	if err != nil {
+		return err
+	}
+	defer func() { p.srv.end(ss, err) }()
+	conn, unpin, err := p.timedaccept()
+	if err != nil {
+		p.srv.logln("timedaccept", err)
+		return err
+	}
+	defer unpin()
+	defer p.srv.track(conn)()
+
+	m := newmeter()
+	err = xfer.Send(conn, n, p.srv.opt.Buf, &m.moved)
+	*r = m.result()
+	r.CPU = usage(ss.cpu0, cputimes())
+	ss.Sent, ss.CPU = r.Bytes, r.CPU
+	if err != nil {
+		p.srv.logln("Send error: ", err)
+		return err
+	}
+	return nil
+}
+
+// txnsize checks the size of a request or response that a client asks for,
+// which the server allocates.
+func txnsize(what string, n uint64) error {
+	if n == 0 || n > stats.MaxTxn {
+		return fmt.Errorf("%s of %d bytes: must be from 1 byte to %d", what, n, stats.MaxTxn)
+	}
+	return nil
+}
+
+// acceptloop accepts payload connections and hands each to serve until the
+// listener is closed by TCPStop, or none arrives for the accept timeout. It
+// returns the number of connections served.
+func (p *TCPPerf) acceptloop(serve func(net.Conn)) (uint64, error) {
+	l := p.listener()
+	if l == nil {
+		err := errors.New("No Payload TCP Listener")
+		p.srv.logln(err)
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	var n uint64
+	for {
+		if dl, ok := l.(interface{ SetDeadline(time.Time) error }); ok {
+			dl.SetDeadline(time.Now().Add(5 * time.Second))
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			wg.Wait()
+			if errors.Is(err, net.ErrClosed) || n > 0 {
+				return n, nil
+			}
+			p.srv.logln("Accept", err)
+			return n, err
+		}
+		n++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.srv.track(conn)()
+			defer pin(l, conn)()
+			serve(conn)
+		}()
+	}
+}
+
+// TCPCrr method serves short lived connections on the payload listener: it reads a
+// request of the number of bytes given by the first parameter, answers with as many
+// bytes and closes, so that the TIME_WAIT state is left on the server. It stores the
+// number of connections served at the location given by the second parameter.
+func (p *TCPPerf) TCPCrr(n uint64, r *uint64) (err error) {
+	*r = 0
+	p.srv.logln("TCPCrr called")
+	if err = txnsize("request", n); err != nil {
+		return err
+	}
+	ss, err := p.srv.begin("TCPCrr")
+	if err != nil {
+		return err
+	}
+	defer func() { p.srv.end(ss, err) }()
+	var moved atomic.Uint64
+	ncon, err := p.acceptloop(func(conn net.Conn) {
+		buf := make([]byte, n)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			p.srv.logln("ReadFull error: ", err)
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			p.srv.logln("Write error: ", err)
+			return
+		}
+		moved.Add(n)
+	})
+	*r = ncon
+	ss.Sent, ss.Received = moved.Load(), moved.Load()
+	p.srv.logln("TCPCrr served ", ncon, " connections")
+	return err
+}
+
+// TCPCpy method listens on a TCP host/port specified in the TCPPerf receiver and
+// once established, it copies everything it recieves back to the sender.
+func (p *TCPPerf) TCPCpy(_ uint64, r *uint64) (err error) {
+	*r = 0
+	p.srv.logln("TCPCpy called")
+	ss, err := p.srv.begin("TCPCpy")
+	if err != nil {
+		return err
+	}
+	defer func() { p.srv.end(ss, err) }()
+	conn, unpin, err := p.timedaccept()
+	if err != nil {
+		p.srv.logln("timedaccept", err)
+		return err
+	}
+	defer unpin()
+	defer p.srv.track(conn)()
+
+	ncpy, err := io.Copy(conn, conn)
+	ss.Sent, ss.Received = uint64(ncpy), uint64(ncpy)
+	if err != nil {
+		p.srv.logln("Copy error: ", err)
+		return err
+	}
+	*r = uint64(ncpy)
+	return nil
+}
+
+// TCPRR method is TCPCpy for transactions: once the payload connection is
+// established, it answers every request of sz.Req bytes with sz.Resp bytes until
+// the client closes. It stores the number of transactions served at the location
+// given by the second parameter.
+func (p *TCPPerf) TCPRR(sz stats.TxnSize, r *uint64) (err error) {
+	*r = 0
+	p.srv.logln("TCPRR called")
+	if err = txnsize("request", sz.Req); err != nil {
+		return err
+	}
+	if err = txnsize("response", sz.Resp); err != nil {
+		return err
+	}
+	ss, err := p.srv.begin("TCPRR")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ss.Received, ss.Sent = *r*sz.Req, *r*sz.Resp
+		p.srv.end(ss, err)
+	}()
+	conn, unpin, err := p.timedaccept()
+	if err != nil {
+		p.srv.logln("timedaccept", err)
+		return err
+	}
+	defer unpin()
+	defer p.srv.track(conn)()
+
+	req := make([]byte, sz.Req)
+	resp := make([]byte, sz.Resp)
+	for {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.ReadFull(conn, req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			p.srv.logln("ReadFull error: ", err)
+			return err
+		}
+		if _, err = conn.Write(resp); err != nil {
+			p.srv.logln("Write error: ", err)
+			return err
+		}
+		*r++
+	}
+}
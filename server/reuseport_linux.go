@@ -0,0 +1,5 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package server
+
+const soReusePort = 0xf // SO_REUSEPORT, missing from syscall on some arches
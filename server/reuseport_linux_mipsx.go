@@ -0,0 +1,5 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package server
+
+const soReusePort = 0x200 // SO_REUSEPORT, missing from syscall on some arches
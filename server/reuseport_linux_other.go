@@ -0,0 +1,6 @@
+//go:build linux && !(386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x || mips || mipsle || mips64 || mips64le)
+
+package server
+
+// SO_REUSEPORT differs between arches, and isn't known on this one
+const soReusePort = 0
@@ -0,0 +1,230 @@
+// Package server is the far end of tcpmeter's measurements: it answers the
+// TCPPerf RPC calls of a client and moves the payload.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Options configure a Server.
+type Options struct {
+	// Listen opens the listeners for the payload; it is net.Listen if nil.
+	// It may wrap them, say with impair.Listen to emulate a poorer link.
+	Listen func(network, address string) (net.Listener, error)
+
+	// Buf is the largest read or write of UP and DOWN payload; 0 for the
+	// default.
+	Buf int
+
+	// Logf, if not nil, is given a trace of the calls the server serves.
+	Logf func(format string, v ...any)
+
+	// Cores, if more than 1, spreads the payload connections of a test
+	// over that many listeners sharing the port with SO_REUSEPORT, opened
+	// in place of Listen's, and Pin binds the goroutine serving each to a
+	// core of its own listener. Linux only; elsewhere the server keeps to
+	// one listener.
+	Cores int
+	Pin   bool
+
+	// OnSessionStart and OnSessionEnd, if not nil, are called as each
+	// payload transfer starts and ends. They may be called from several
+	// goroutines at once.
+	OnSessionStart func(Session)
+	OnSessionEnd   func(Session)
+}
+
+// Session is one payload transfer of a Server.
+type Session struct {
+	ID       uint64 // in the order they started
+	Method   string // the TCPPerf method: TCPRcv, TCPSnd, TCPCrr, TCPCpy or TCPRR
+	Start    time.Time
+	End      time.Time // zero until it ends
+	Sent     uint64    // payload bytes
+	Received uint64
+	Err      error     // why it failed, if it did
+	CPU      []float64 // busy fraction of each core of the host while it lasted; nil if unknown
+
+	cpu0 []cputime // at the start
+}
+
+// ErrServerClosed is returned by Serve, and by calls of clients, once
+// Shutdown has been called.
+var ErrServerClosed = errors.New("server: shut down")
+
+// Server serves TCPPerf to tcpmeter clients.
+type Server struct {
+	opt Options
+
+	mu        sync.Mutex
+	closing   bool
+	nsess     uint64
+	sessions  sync.WaitGroup
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{} // of RPC clients and payload
+	perfs     map[*TCPPerf]struct{} // of the RPC clients
+}
+
+// New returns a Server configured by opt.
+func New(opt Options) *Server {
+	if opt.Listen == nil {
+		opt.Listen = net.Listen
+	}
+	return &Server{opt: opt, listeners: make(map[net.Listener]struct{}),
+		conns: make(map[net.Conn]struct{}), perfs: make(map[*TCPPerf]struct{})}
+}
+
+// Serve answers the RPC calls of the clients that connect to l until
+// accepting fails, and returns that error, or ErrServerClosed after
+// Shutdown. Payload listeners are opened on the address of l, or on every
+// address if l's is unspecified.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	var host string
+	if a, ok := l.Addr().(*net.TCPAddr); ok && !a.IP.IsUnspecified() {
+		host = a.IP.String()
+	}
+	s.logln("Starting server on ", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveconn(conn, host)
+	}
+}
+
+// serveconn answers the RPC calls of a client on c with a TCPPerf of its
+// own, so that clients don't close each other's payload listeners.
+func (s *Server) serveconn(c net.Conn, host string) {
+	defer s.track(c)()
+	p := &TCPPerf{srv: s, host: host}
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("TCPPerf", p); err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	s.perfs[p] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.perfs, p)
+		s.mu.Unlock()
+		p.stop()
+	}()
+	rs.ServeConn(c)
+}
+
+// Shutdown stops the Server accepting clients and tests, waits for the
+// sessions under way to end and then closes the connections of its
+// clients. If ctx is done first, it closes them at once, which ends the
+// sessions, and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(idle)
+	}()
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	for p := range s.perfs {
+		p.stop()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Server) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// track remembers c, so that Shutdown can close it; the returned function
+// forgets and closes it.
+func (s *Server) track(c net.Conn) func() {
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}
+}
+
+// logln logs v through Options.Logf in the manner of log.Println.
+func (s *Server) logln(v ...any) {
+	if s.opt.Logf != nil {
+		s.opt.Logf("%s", fmt.Sprintln(v...))
+	}
+}
+
+// begin starts a session of method, unless the server is shutting down.
+func (s *Server) begin(method string) (*Session, error) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	s.nsess++
+	ss := &Session{ID: s.nsess, Method: method, Start: time.Now()}
+	s.sessions.Add(1)
+	s.mu.Unlock()
+	ss.cpu0 = cputimes()
+
+	if s.opt.OnSessionStart != nil {
+		s.opt.OnSessionStart(*ss)
+	}
+	return ss, nil
+}
+
+// end ends ss with err.
+func (s *Server) end(ss *Session, err error) {
+	ss.End, ss.Err = time.Now(), err
+	if ss.CPU == nil {
+		ss.CPU = usage(ss.cpu0, cputimes())
+	}
+	if s.opt.OnSessionEnd != nil {
+		s.opt.OnSessionEnd(*ss)
+	}
+	s.sessions.Done()
+}
@@ -0,0 +1,161 @@
+// Package stats has the types that tcpmeter's client and server use to
+// describe a measurement and its results.
+package stats
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Period is the length of a timeline reporting period, on either end.
+const Period = 500 * time.Millisecond
+
+// Config defines the far-end server, and its command and payload ports
+type Config struct {
+	Host    string
+	RPCPort string
+	Count   uint64
+	Repeat  bool
+	Omit    time.Duration // warm-up period left out of the final average
+	Steady  float64       // relative std deviation below which the rate is stable; 0 disables
+	Stop    bool          // end the test as soon as the rate is stable
+	Dur     time.Duration // length of transaction tests
+	Req     uint64        // request size of RR transactions
+	Resp    uint64        // response size of RR transactions
+	Buf     uint64        // largest read or write of UP and DOWN payload; 0 for the default
+}
+
+// BitRate is a rate in bits per second.
+type BitRate uint64
+
+// Rate returns the rate at which n bytes move in d, or 0 if d isn't
+// positive. It is exact to the bit per second for any n, and saturates
+// rather than overflow.
+func Rate(n uint64, d time.Duration) BitRate {
+	if d <= 0 {
+		return 0
+	}
+	hi, lo := bits.Mul64(n, 8*uint64(time.Second))
+	if hi >= uint64(d) {
+		return math.MaxUint64
+	}
+	q, _ := bits.Div64(hi, lo, uint64(d))
+	return BitRate(q)
+}
+
+// Mean returns the average of rs, or 0 if there are none.
+func Mean(rs []BitRate) BitRate {
+	if len(rs) == 0 {
+		return 0
+	}
+	var hi, lo, c uint64
+	for _, r := range rs {
+		lo, c = bits.Add64(lo, uint64(r), 0)
+		hi += c
+	}
+	q, _ := bits.Div64(hi, lo, uint64(len(rs)))
+	return BitRate(q)
+}
+
+// Returns bitrate in Mega-bits per second
+func (b BitRate) Mbps() float64 {
+	return float64(b) / 1e6
+}
+
+// Returns bitrate in Mega-bytes per second
+func (b BitRate) MBps() float64 {
+	return float64(b) / 8e6
+}
+
+// Returns bitrate in Kilo-bits per second
+func (b BitRate) Kbps() float64 {
+	return float64(b) / 1e3
+}
+
+// Returns bitrate in Kilo-bytes per second
+func (b BitRate) KBps() float64 {
+	return float64(b) / 8e3
+}
+
+func (b BitRate) String() string {
+	return fmt.Sprintf("%d", b)
+}
+
+// Summary is the final account of a measurement.
+type Summary struct {
+	Bytes    uint64        // bytes counted by the client
+	SrvBytes uint64        // bytes counted by the server
+	Elapsed  time.Duration // excluding any warm-up
+	Avg      BitRate       // overall average, excluding any warm-up
+	Peak     BitRate       // fastest interval
+	Min      BitRate       // slowest interval
+	StdDev   BitRate       // of the interval rates
+
+	SrvElapsed  time.Duration // transfer time seen by the server
+	Timeline    []Interval    // bytes, or transactions, per period seen by the client
+	SrvTimeline []Interval    // bytes per period seen by the server
+	Send        BitRate       // whole transfer rate seen by the sender; 0 if that is the server and its call failed
+	Recv        BitRate       // whole transfer rate seen by the receiver; 0 if that is the server and its call failed
+	Skewed      bool          // Send and Recv differ by more than the client allows
+	SrvCPU      []float64     // busy fraction of each core of the server; nil if unknown
+
+	Txns uint64   // transactions completed
+	TPS  float64  // transactions per second
+	Lat  *Latency // per transaction latency
+
+	Cfg Config // what was measured
+}
+
+// Latency is the distribution of a set of durations.
+type Latency struct {
+	N    int
+	Min  time.Duration
+	Mean time.Duration
+	Max  time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	P999 time.Duration
+	Hist []uint64 `json:",omitempty"` // counts by Bucket
+}
+
+// Buckets is the number of latency histogram buckets; the last also counts
+// anything longer.
+const Buckets = 24
+
+// Bucket returns the latency histogram bucket of d: bucket 0 counts
+// durations under 2µs and bucket i > 0 those from 2^i up to 2^(i+1)µs.
+func Bucket(d time.Duration) int {
+	us := uint64(d / time.Microsecond)
+	if us < 2 {
+		return 0
+	}
+	return min(bits.Len64(us)-1, Buckets-1)
+}
+
+// Interval is the number of bytes moved during one reporting period that
+// ended At after the start of the transfer.
+type Interval struct {
+	At    time.Duration
+	Bytes uint64
+}
+
+// XferResult is the server's own account of a TCPRcv or TCPSnd transfer.
+type XferResult struct {
+	Bytes    uint64
+	Elapsed  time.Duration
+	Timeline []Interval
+	CPU      []float64 // busy fraction of each core of the server; nil if unknown
+}
+
+// MaxTxn is the largest request or response of a CRR or RR transaction
+// that a server takes.
+const MaxTxn = 1 << 20
+
+// TxnSize gives the request and response sizes of a TCPRR transaction.
+type TxnSize struct {
+	Req  uint64
+	Resp uint64
+}
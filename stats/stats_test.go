@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	gbps = 1000000000 // bits per second
+	tb   = 1000000000000
+)
+
+func TestRate(t *testing.T) {
+	for _, c := range []struct {
+		n    uint64
+		d    time.Duration
+		want BitRate
+	}{
+		{1, time.Nanosecond, 8 * gbps},
+		{3000000000, time.Second, 24 * gbps},        // past where n*8e9 overflows
+		{45 * tb, time.Hour, 100 * gbps},            // 100 Gbps for an hour
+		{4320 * tb, 24 * time.Hour, 400 * gbps},     // 400 Gbps for a day
+		{100*gbps/8 + 1, time.Second, 100*gbps + 8}, // to the bit
+		{1234567890123, time.Second, 9876543120984},
+		{10 * tb, 3 * time.Second, 26666666666666},                // rounded down
+		{math.MaxUint64, time.Nanosecond, math.MaxUint64},         // saturates
+		{math.MaxUint64 / 8, time.Second, math.MaxUint64 / 8 * 8}, // 147 EB in a second
+		{1, 0, 0},
+		{1, -time.Second, 0},
+	} {
+		if got := Rate(c.n, c.d); got != c.want {
+			t.Errorf("Rate(%d, %v) = %d, want %d", c.n, c.d, got, c.want)
+		}
+	}
+}
+
+func TestMean(t *testing.T) {
+	for _, c := range []struct {
+		rs   []BitRate
+		want BitRate
+	}{
+		{nil, 0},
+		{[]BitRate{100 * gbps, 200 * gbps}, 150 * gbps},
+		{[]BitRate{math.MaxUint64, math.MaxUint64 - 2}, math.MaxUint64 - 1},
+		{[]BitRate{math.MaxUint64, math.MaxUint64, math.MaxUint64}, math.MaxUint64},
+	} {
+		if got := Mean(c.rs); got != c.want {
+			t.Errorf("Mean(%v) = %d, want %d", c.rs, got, c.want)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	b := BitRate(100*gbps + 8)
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"Mbps", b.Mbps(), 100000.000008},
+		{"MBps", b.MBps(), 12500.000001},
+		{"Kbps", b.Kbps(), 100000000.008},
+		{"KBps", b.KBps(), 12500000.001},
+	} {
+		if math.Abs(c.got-c.want) > c.want*1e-12 {
+			t.Errorf("%s of %d = %f, want %f", c.name, b, c.got, c.want)
+		}
+	}
+}
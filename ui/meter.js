@@ -0,0 +1,253 @@
+// meter.js has the little the tcpmeter pages need, so that they work
+// without any outside scripts: DOM and http helpers, and a chart and a
+// gauge drawn on a canvas.
+var M = (function () {
+    var M = {};
+
+    M.$ = function (sel, root) { return (root || document).querySelector(sel); };
+    M.$$ = function (sel, root) {
+        return Array.prototype.slice.call((root || document).querySelectorAll(sel));
+    };
+    M.html = function (sel, h) { M.$(sel).innerHTML = h; };
+    // esc makes text safe to put into html, in elements or quoted attributes
+    M.esc = function (s) {
+        return String(s).replace(/[&<>"']/g, function (c) {
+            return { '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c];
+        });
+    };
+
+    // request sends body, if any, as a form and calls done with the text of
+    // a successful response or fail with the error.
+    M.request = function (method, url, body, done, fail) {
+        var x = new XMLHttpRequest();
+        x.open(method, url);
+        if (body != null) x.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+        x.onload = function () {
+            if (x.status >= 200 && x.status < 300) {
+                if (done) done(x.responseText);
+            } else if (fail) {
+                fail(x.responseText || x.statusText);
+            }
+        };
+        x.onerror = function () { if (fail) fail("network error"); };
+        x.send(body);
+    };
+    M.getJSON = function (url, done, fail) {
+        M.request("GET", url, null, function (t) { done(JSON.parse(t)); }, fail);
+    };
+    // form encodes the enabled fields of a form
+    M.form = function (f) { return new URLSearchParams(new FormData(f)).toString(); };
+
+    var colors = ["#3366cc", "#dc3912", "#ff9900", "#109618", "#990099"];
+
+    // nice rounds a tick step up to 1, 2 or 5 times a power of ten
+    var nice = function (span, n) {
+        var raw = span / n;
+        if (!(raw > 0)) return 1;
+        var mag = Math.pow(10, Math.floor(Math.log(raw) / Math.LN10));
+        var f = raw / mag;
+        return mag * (f <= 1 ? 1 : f <= 2 ? 2 : f <= 5 ? 5 : 10);
+    };
+    var fmt = function (v) {
+        return Math.abs(v) >= 1000 ? v.toFixed(0) : String(+v.toPrecision(3));
+    };
+
+    // Chart draws series of [x, y] points on a canvas. Options:
+    // title, ylabel, legend, dots (mark each point), lines (false for
+    // a scatter plot), time (x is a Date or milliseconds), xmin, xmax.
+    M.Chart = function (canvas, opts) {
+        this.c = canvas;
+        this.o = opts || {};
+    };
+    // draw replaces what's on the chart with series, a list of
+    // { name: "...", points: [[x, y], ...] }.
+    M.Chart.prototype.draw = function (series) {
+        var c = this.c, o = this.o, g = c.getContext("2d");
+        var W = c.width, H = c.height;
+        var legend = o.legend && series.length > 0;
+        var L = o.ylabel ? 62 : 48, R = 12, T = o.title ? 26 : 10, B = legend ? 44 : 24;
+        var x0 = Infinity, x1 = -Infinity, y0 = 0, y1 = -Infinity;
+        series.forEach(function (s) {
+            s.points.forEach(function (p) {
+                var x = +p[0];
+                x0 = Math.min(x0, x);
+                x1 = Math.max(x1, x);
+                y0 = Math.min(y0, p[1]);
+                y1 = Math.max(y1, p[1]);
+            });
+        });
+        if (o.xmin != null) x0 = o.xmin;
+        if (o.xmax != null) x1 = o.xmax;
+        if (!(x1 > x0)) {
+            x0 = isFinite(x0) ? x0 - 1 : 0;
+            x1 = x0 + 2;
+        }
+        if (!(y1 > y0)) y1 = y0 + 1;
+        var ystep = nice(y1 - y0, 5);
+        y1 = Math.ceil(y1 / ystep) * ystep;
+        var px = function (x) { return L + (x - x0) / (x1 - x0) * (W - L - R); };
+        var py = function (y) { return H - B - (y - y0) / (y1 - y0) * (H - T - B); };
+
+        g.clearRect(0, 0, W, H);
+        g.font = "11px sans-serif";
+        g.lineWidth = 1;
+        if (o.title) {
+            g.fillStyle = "#000";
+            g.textAlign = "center";
+            g.textBaseline = "top";
+            g.font = "bold 12px sans-serif";
+            g.fillText(o.title, W / 2, 6);
+            g.font = "11px sans-serif";
+        }
+        if (o.ylabel) {
+            g.save();
+            g.translate(12, (T + H - B) / 2);
+            g.rotate(-Math.PI / 2);
+            g.textAlign = "center";
+            g.textBaseline = "middle";
+            g.fillStyle = "#444";
+            g.fillText(o.ylabel, 0, 0);
+            g.restore();
+        }
+
+        // grid and y axis
+        g.textAlign = "right";
+        g.textBaseline = "middle";
+        for (var y = y0; y <= y1 + ystep / 2; y += ystep) {
+            g.strokeStyle = "#e4e4e4";
+            g.beginPath();
+            g.moveTo(L, Math.round(py(y)) + 0.5);
+            g.lineTo(W - R, Math.round(py(y)) + 0.5);
+            g.stroke();
+            g.fillStyle = "#444";
+            g.fillText(fmt(y), L - 4, py(y));
+        }
+        // x axis
+        g.textAlign = "center";
+        g.textBaseline = "top";
+        var xstep = o.time ? (x1 - x0) / 4 : nice(x1 - x0, 6);
+        var days = o.time && x1 - x0 > 2 * 86400000;
+        for (var x = o.time ? x0 : Math.ceil(x0 / xstep) * xstep; x <= x1 + xstep / 100; x += xstep) {
+            var lab = fmt(x);
+            if (o.time) {
+                var d = new Date(x);
+                lab = days ? d.toLocaleDateString() : d.toLocaleTimeString();
+            }
+            g.fillText(lab, px(x), H - B + 4);
+        }
+        g.strokeStyle = "#888";
+        g.beginPath();
+        g.moveTo(L + 0.5, T);
+        g.lineTo(L + 0.5, H - B + 0.5);
+        g.lineTo(W - R, H - B + 0.5);
+        g.stroke();
+
+        // the series, clipped to the plot
+        g.save();
+        g.beginPath();
+        g.rect(L, T - 2, W - L - R, H - T - B + 4);
+        g.clip();
+        series.forEach(function (s, i) {
+            var col = s.color || colors[i % colors.length];
+            g.strokeStyle = g.fillStyle = col;
+            g.lineWidth = 2;
+            if (o.lines !== false) {
+                g.beginPath();
+                s.points.forEach(function (p, j) {
+                    if (j == 0) g.moveTo(px(+p[0]), py(p[1]));
+                    else g.lineTo(px(+p[0]), py(p[1]));
+                });
+                g.stroke();
+            }
+            if (o.dots || o.lines === false) {
+                s.points.forEach(function (p) {
+                    g.beginPath();
+                    g.arc(px(+p[0]), py(p[1]), 3, 0, 2 * Math.PI);
+                    g.fill();
+                });
+            }
+        });
+        g.restore();
+
+        if (legend) {
+            g.textAlign = "left";
+            g.textBaseline = "middle";
+            var lx = L;
+            series.forEach(function (s, i) {
+                g.fillStyle = s.color || colors[i % colors.length];
+                g.fillRect(lx, H - 12, 10, 10);
+                g.fillStyle = "#000";
+                g.fillText(s.name, lx + 14, H - 7);
+                lx += 24 + g.measureText(s.name).width;
+            });
+        }
+    };
+
+    // Gauge draws a dial from 0 to opts.max, default 100, with its label
+    // and coloured bands, given as [[from, to, colour], ...].
+    M.Gauge = function (canvas, opts) {
+        this.c = canvas;
+        this.o = opts || {};
+    };
+    M.Gauge.prototype.draw = function (v) {
+        var c = this.c, o = this.o, g = c.getContext("2d");
+        var W = c.width, H = c.height, cx = W / 2, cy = H / 2;
+        var r = Math.min(W, H) / 2 - 4, max = o.max || 100, n = o.ticks || 5;
+        // the dial sweeps clockwise through 270 degrees from the lower left
+        var ang = function (x) {
+            return Math.PI * 0.75 + Math.min(Math.max(x / max, 0), 1) * Math.PI * 1.5;
+        };
+
+        g.clearRect(0, 0, W, H);
+        g.beginPath();
+        g.arc(cx, cy, r, 0, 2 * Math.PI);
+        g.fillStyle = "#f7f7f7";
+        g.fill();
+        g.strokeStyle = "#ccc";
+        g.lineWidth = 2;
+        g.stroke();
+
+        (o.bands || []).forEach(function (b) {
+            g.beginPath();
+            g.arc(cx, cy, r * 0.8, ang(b[0]), ang(b[1]));
+            g.strokeStyle = b[2];
+            g.lineWidth = r * 0.12;
+            g.stroke();
+        });
+
+        g.strokeStyle = g.fillStyle = "#333";
+        g.lineWidth = 1;
+        g.font = Math.round(r * 0.12) + "px sans-serif";
+        g.textAlign = "center";
+        g.textBaseline = "middle";
+        for (var i = 0; i <= n; i++) {
+            var a = ang(max * i / n), cs = Math.cos(a), sn = Math.sin(a);
+            g.beginPath();
+            g.moveTo(cx + cs * r * 0.72, cy + sn * r * 0.72);
+            g.lineTo(cx + cs * r * 0.88, cy + sn * r * 0.88);
+            g.stroke();
+            g.fillText(fmt(max * i / n), cx + cs * r * 0.58, cy + sn * r * 0.58);
+        }
+
+        if (o.label) {
+            g.font = Math.round(r * 0.15) + "px sans-serif";
+            g.fillText(o.label, cx, cy - r * 0.32);
+        }
+        g.font = "bold " + Math.round(r * 0.18) + "px sans-serif";
+        g.fillText(fmt(v), cx, cy + r * 0.55);
+
+        var a = ang(v);
+        g.beginPath();
+        g.moveTo(cx, cy);
+        g.lineTo(cx + Math.cos(a) * r * 0.78, cy + Math.sin(a) * r * 0.78);
+        g.strokeStyle = "#c63310";
+        g.lineWidth = 3;
+        g.stroke();
+        g.beginPath();
+        g.arc(cx, cy, r * 0.07, 0, 2 * Math.PI);
+        g.fillStyle = "#4684ee";
+        g.fill();
+    };
+
+    return M;
+})();
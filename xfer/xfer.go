@@ -0,0 +1,105 @@
+// Package xfer moves the payload of tcpmeter's UP and DOWN tests as fast as
+// the system allows: on Linux, a TCP connection is written from a pipe of
+// zeros and read into /dev/null without copying through user space.
+package xfer
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBuf = 1 << 20 // largest read or write, unless told otherwise
+	minChunk   = 8 << 10
+	pace       = 20 * time.Millisecond // chunks grow while they take less
+)
+
+// longest a chunk may take before the transfer fails
+var idle = 5 * time.Second
+
+// chunks sizes the reads or writes of a transfer: they start small, so that
+// a slow link still shows progress, and grow up to max while they are quick.
+type chunks struct {
+	size, max int
+}
+
+func newchunks(max int) *chunks {
+	if max <= 0 {
+		max = DefaultBuf
+	}
+	return &chunks{size: min(minChunk, max), max: max}
+}
+
+// next returns the size of the next chunk, of left bytes to go.
+func (c *chunks) next(left uint64) int {
+	return int(min(uint64(c.size), left))
+}
+
+// took adjusts the size to how long the last chunk took.
+func (c *chunks) took(d time.Duration) {
+	switch {
+	case d < pace && c.size < c.max:
+		c.size = min(2*c.size, c.max)
+	case d > 4*pace && c.size > minChunk:
+		c.size /= 2
+	}
+}
+
+// Send writes n zero bytes to c, in writes of at most buf bytes, and adds
+// each to moved as it goes. It fails if a write takes longer than 5s.
+func Send(c net.Conn, n uint64, buf int, moved *atomic.Uint64) error {
+	ch := newchunks(buf)
+	if tc, ok := c.(*net.TCPConn); ok {
+		if handled, err := sendfast(tc, n, ch, moved); handled {
+			return err
+		}
+	}
+	b := make([]byte, ch.max)
+	for done := uint64(0); done < n; {
+		k := ch.next(n - done)
+		t := time.Now()
+		c.SetWriteDeadline(t.Add(idle))
+		nw, err := c.Write(b[:k])
+		done += uint64(nw)
+		moved.Add(uint64(nw))
+		if err != nil {
+			return err
+		}
+		if nw != k {
+			return io.ErrShortWrite
+		}
+		ch.took(time.Since(t))
+	}
+	return nil
+}
+
+// Receive reads n bytes from c and discards them, in reads of at most buf
+// bytes, adding each to moved as it goes. It fails if a read takes longer
+// than 5s, and with io.ErrUnexpectedEOF if c ends early.
+func Receive(c net.Conn, n uint64, buf int, moved *atomic.Uint64) error {
+	ch := newchunks(buf)
+	if tc, ok := c.(*net.TCPConn); ok {
+		if handled, err := recvfast(tc, n, ch, moved); handled {
+			return err
+		}
+	}
+	b := make([]byte, ch.max)
+	for done := uint64(0); done < n; {
+		k := ch.next(n - done)
+		t := time.Now()
+		c.SetReadDeadline(t.Add(idle))
+		nr, err := io.ReadFull(c, b[:k])
+		done += uint64(nr)
+		moved.Add(uint64(nr))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		ch.took(time.Since(t))
+	}
+	return nil
+}
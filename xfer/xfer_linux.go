@@ -0,0 +1,150 @@
+package xfer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	fSetPipeSz = 1031
+	fGetPipeSz = 1032
+
+	spliceMove     = 1
+	spliceNonblock = 2
+)
+
+// pipe returns the ends of a pipe that holds up to size bytes, if it may,
+// and how many it holds.
+func pipe(size int) (r, w, n int, err error) {
+	var p [2]int
+	if err = syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return 0, 0, 0, err
+	}
+	syscall.Syscall(syscall.SYS_FCNTL, uintptr(p[1]), fSetPipeSz, uintptr(size))
+	sz, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p[1]), fGetPipeSz, 0)
+	if errno != 0 {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return 0, 0, 0, errno
+	}
+	return p[0], p[1], int(sz), nil
+}
+
+// unsupported reports whether err means that tee or splice can't be used
+// here at all.
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM)
+}
+
+// sendfast sends n zero bytes to c without copying them: a pipe is filled
+// with zeros once, and each chunk is tee'd from it into a second pipe and
+// spliced from that to c. It reports false if it can't, before sending
+// anything, which includes when the pipes can't hold the chunks asked for.
+func sendfast(c *net.TCPConn, n uint64, ch *chunks, moved *atomic.Uint64) (bool, error) {
+	zr, zw, size, err := pipe(ch.max)
+	if err != nil {
+		return false, nil
+	}
+	defer syscall.Close(zr)
+	defer syscall.Close(zw)
+	pr, pw, psize, err := pipe(size)
+	if err != nil {
+		return false, nil
+	}
+	defer syscall.Close(pr)
+	defer syscall.Close(pw)
+	if min(size, psize) < ch.max {
+		// over /proc/sys/fs/pipe-max-size, without the privilege to go
+		// beyond it; chunks of the size asked for are copied instead
+		return false, nil
+	}
+
+	zeros := make([]byte, size)
+	for off := 0; off < size; {
+		k, err := syscall.Write(zw, zeros[off:])
+		if err != nil {
+			return false, nil
+		}
+		off += k
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var done uint64
+	for done < n {
+		k := ch.next(n - done)
+		t := time.Now()
+		c.SetWriteDeadline(t.Add(idle))
+		m, err := syscall.Tee(zr, pw, k, 0)
+		if err != nil {
+			if done == 0 && unsupported(err) {
+				return false, nil
+			}
+			return true, os.NewSyscallError("tee", err)
+		}
+		for left := int(m); left > 0; {
+			var serr error
+			err := rc.Write(func(fd uintptr) bool {
+				s, e := syscall.Splice(pr, nil, int(fd), nil, left, spliceMove|spliceNonblock)
+				switch {
+				case e == syscall.EAGAIN:
+					return false
+				case e != nil:
+					serr = os.NewSyscallError("splice", e)
+					return true
+				case s == 0:
+					serr = io.ErrShortWrite
+					return true
+				}
+				left -= int(s)
+				done += uint64(s)
+				moved.Add(uint64(s))
+				return true
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				if done == 0 && unsupported(err) {
+					return false, nil
+				}
+				return true, err
+			}
+		}
+		ch.took(time.Since(t))
+	}
+	return true, nil
+}
+
+// recvfast reads n bytes from c into /dev/null, which the os package
+// splices without copying them. It reports false if it can't.
+func recvfast(c *net.TCPConn, n uint64, ch *chunks, moved *atomic.Uint64) (bool, error) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return false, nil
+	}
+	defer null.Close()
+	for done := uint64(0); done < n; {
+		k := ch.next(n - done)
+		t := time.Now()
+		c.SetReadDeadline(t.Add(idle))
+		m, err := io.CopyN(null, c, int64(k))
+		done += uint64(m)
+		moved.Add(uint64(m))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return true, err
+		}
+		ch.took(time.Since(t))
+	}
+	return true, nil
+}
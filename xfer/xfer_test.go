@@ -0,0 +1,185 @@
+package xfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// plain hides the type of a connection, so that it is moved without the
+// fast paths.
+type plain struct {
+	net.Conn
+}
+
+// pair returns the two ends of a loopback TCP connection.
+func pair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+var paths = []struct {
+	name string
+	wrap func(net.Conn) net.Conn
+}{
+	{"fast", func(c net.Conn) net.Conn { return c }},
+	{"plain", func(c net.Conn) net.Conn { return plain{c} }},
+}
+
+func TestSendReceive(t *testing.T) {
+	const n = 64<<20 + 12345
+	for _, s := range paths {
+		for _, r := range paths {
+			t.Run(s.name+"-"+r.name, func(t *testing.T) {
+				a, b := pair(t)
+				var sent, got atomic.Uint64
+				errc := make(chan error, 1)
+				go func() { errc <- Send(s.wrap(a), n, 256<<10, &sent) }()
+				if err := Receive(r.wrap(b), n, 256<<10, &got); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				if sent.Load() != n || got.Load() != n {
+					t.Errorf("sent %d and received %d, want %d", sent.Load(), got.Load(), n)
+				}
+			})
+		}
+	}
+}
+
+// TestSendPipeMax checks that writes over the largest pipe the system
+// allows are still as large as asked for.
+func TestSendPipeMax(t *testing.T) {
+	b, err := os.ReadFile("/proc/sys/fs/pipe-max-size")
+	if err != nil {
+		t.Skip("no pipe size limit here")
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, c := pair(t)
+	go io.Copy(io.Discard, c)
+	ch := newchunks(2 * max)
+	var moved atomic.Uint64
+	if handled, err := sendfast(a.(*net.TCPConn), 1<<20, ch, &moved); handled && err != nil {
+		t.Fatal(err)
+	}
+	if ch.max != 2*max {
+		t.Errorf("writes of up to %d bytes, want the %d asked for", ch.max, 2*max)
+	}
+}
+
+func TestSendZeros(t *testing.T) {
+	for _, s := range paths {
+		a, b := pair(t)
+		var sent atomic.Uint64
+		go Send(s.wrap(a), 3<<20, 0, &sent)
+		buf := make([]byte, 3<<20)
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, make([]byte, len(buf))) {
+			t.Errorf("%s: sent other than zeros", s.name)
+		}
+	}
+}
+
+func TestReceiveEarlyEOF(t *testing.T) {
+	for _, r := range paths {
+		a, b := pair(t)
+		a.Write(make([]byte, 1000))
+		a.Close()
+		var got atomic.Uint64
+		err := Receive(r.wrap(b), 1<<20, 0, &got)
+		if err != io.ErrUnexpectedEOF || got.Load() != 1000 {
+			t.Errorf("%s: received %d bytes and %v, want 1000 and %v", r.name, got.Load(), err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	defer func(d time.Duration) { idle = d }(idle)
+	idle = 100 * time.Millisecond
+	for _, s := range paths {
+		a, _ := pair(t) // whose peer never reads
+		var sent atomic.Uint64
+		err := Send(s.wrap(a), 1<<30, 0, &sent)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: Send to a stalled peer: %v, want a timeout", s.name, err)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	ch := newchunks(1 << 20)
+	if k := ch.next(1 << 30); k != minChunk {
+		t.Errorf("first chunk %d, want %d", k, minChunk)
+	}
+	for i := 0; i < 20; i++ {
+		ch.took(time.Millisecond)
+	}
+	if k := ch.next(1 << 30); k != 1<<20 {
+		t.Errorf("chunk after quick ones %d, want %d", k, 1<<20)
+	}
+	if k := ch.next(100); k != 100 {
+		t.Errorf("last chunk %d, want 100", k)
+	}
+	for i := 0; i < 20; i++ {
+		ch.took(time.Second)
+	}
+	if k := ch.next(1 << 30); k != minChunk {
+		t.Errorf("chunk after slow ones %d, want %d", k, minChunk)
+	}
+}
+
+// BenchmarkLoopback reports the throughput of each path over the loopback.
+func BenchmarkLoopback(b *testing.B) {
+	const n = 1 << 30
+	for _, p := range paths {
+		b.Run(p.name, func(b *testing.B) {
+			a, c := pair(b)
+			var sent, got atomic.Uint64
+			b.SetBytes(n)
+			b.ResetTimer()
+			t0 := time.Now()
+			for i := 0; i < b.N; i++ {
+				errc := make(chan error, 1)
+				go func() { errc <- Send(p.wrap(a), n, DefaultBuf, &sent) }()
+				if err := Receive(p.wrap(c), n, DefaultBuf, &got); err != nil {
+					b.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(got.Load())*8/time.Since(t0).Seconds()/1e9, "Gbps")
+		})
+	}
+}